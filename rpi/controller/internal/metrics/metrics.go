@@ -0,0 +1,181 @@
+// Package metrics provides minimal counters and gauges exported in the Prometheus text format.
+// Metrics are registered in a process wide registry, so every package can declare its own metrics as package variables.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is a registered metric family that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registry      = make(map[string]metric)
+	registryMutex sync.Mutex
+)
+
+// register adds the metric to the registry, replacing a metric with the same name.
+func register(name string, m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[name] = m
+}
+
+// lookup returns the registered metric with the given name or nil.
+func lookup(name string) metric {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	return registry[name]
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+type counter struct {
+	name    string
+	help    string
+	counter *Counter
+}
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.counter.Value())
+}
+
+// NewCounter registers and returns a counter without labels.
+// Registering the same name again returns the existing counter.
+// Example: var restarts = metrics.NewCounter("controller_restarts_total", "Number of restarts.")
+func NewCounter(name, help string) *Counter {
+	if existing, ok := lookup(name).(*counter); ok {
+		return existing.counter
+	}
+	c := &counter{name: name, help: help, counter: &Counter{}}
+	register(name, c)
+	return c.counter
+}
+
+// CounterVec is a family of counters partitioned by the value of a single label.
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	counters map[string]*Counter
+	mu       sync.Mutex
+}
+
+// NewCounterVec registers and returns a counter family with one label.
+// Registering the same name again returns the existing family, so several packages can share it.
+// Example: var bytes = metrics.NewCounterVec("controller_serial_bytes_total", "Bytes on the serial port.", "direction")
+func NewCounterVec(name, help, label string) *CounterVec {
+	if existing, ok := lookup(name).(*CounterVec); ok {
+		return existing
+	}
+	cv := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	register(name, cv)
+	return cv
+}
+
+// With returns the counter for the given label value, creating it on first use.
+func (cv *CounterVec) With(value string) *Counter {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, ok := cv.counters[value]
+	if !ok {
+		c = &Counter{}
+		cv.counters[value] = c
+	}
+	return c
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	values := make([]string, 0, len(cv.counters))
+	for value := range cv.counters {
+		values = append(values, value)
+	}
+	cv.mu.Unlock()
+	sort.Strings(values)
+
+	writeHeader(w, cv.name, cv.help, "counter")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", cv.name, cv.label, escapeLabel(value), cv.With(value).Value())
+	}
+}
+
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", g.name, g.value())
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn on every scrape.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(name, &gaugeFunc{name: name, help: help, value: fn})
+}
+
+// WriteText writes all registered metrics in the Prometheus text format, sorted by name.
+func WriteText(w io.Writer) {
+	registryMutex.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry[name])
+	}
+	registryMutex.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler returns an http.Handler serving all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// escapeLabel escapes a label value as required by the text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,331 @@
+// Package profiles describes the media pipelines of the controller in a JSON file instead of code.
+// A profile names the input device and format, the encoder, bitrate, resolution and extra ffmpeg arguments of one pipeline.
+// Speaker profiles name the output device, which plays the microphone of the operator.
+// Without PROFILES_FILE the embedded default.json is used, VIDEO_PROFILE, AUDIO_PROFILE and SPEAKER_PROFILE select a profile by name.
+// VIDEO_INGEST, AUDIO_INGEST and SPEAKER_INGEST override the UDP address the RTP of the selected profile is received on.
+package profiles
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Kinds of profiles
+const (
+	KindVideo   = "video"
+	KindAudio   = "audio"
+	KindSpeaker = "speaker"
+)
+
+// Sources of video and audio profiles
+const (
+	SourceFFmpeg    = "ffmpeg"    // ffmpeg captures and encodes the input
+	SourceH264      = "h264"      // H.264 pass-through from a hardware encoder command or from a file or named pipe (input)
+	SourceSynthetic = "synthetic" // embedded VP8 or Opus sample played in a loop without ffmpeg
+	SourceRTP       = "rtp"       // RTP sent to the ingest address by an external producer, e.g. another process or machine
+)
+
+// DefaultIngest receives the RTP of ffmpeg on a free port of the loopback interface, so several controllers do not collide
+const DefaultIngest = "127.0.0.1:0"
+
+// defaultNames are the profiles of each kind used if none is selected: the test pattern and the tone of ffmpeg like before
+// the profiles, a speaker discards the microphone
+var defaultNames = map[string]string{KindVideo: "lavfi", KindAudio: "lavfi", KindSpeaker: "test"}
+
+//go:embed default.json
+var defaultProfiles []byte
+
+// Profile describes one media pipeline
+type Profile struct {
+	Name        string   `json:"name"`
+	Kind        string   `json:"-"` // set by the list the profile is in
+	Description string   `json:"description,omitempty"`
+	Source      string   `json:"source,omitempty"`     // ffmpeg (default), h264 (video only), synthetic or rtp
+	InputArgs   []string `json:"inputArgs,omitempty"`  // ffmpeg arguments before the input, e.g. -re
+	Format      string   `json:"format,omitempty"`     // input format, e.g. dshow, alsa, lavfi
+	Input       string   `json:"input,omitempty"`      // input device, file or named pipe
+	Output      string   `json:"output,omitempty"`     // speaker only: output device, e.g. default for alsa or - for the null format
+	Command     string   `json:"command,omitempty"`    // h264 only: encoder command writing Annex-B to stdout, used without input
+	Codecs      []string `json:"codecs,omitempty"`     // video only: codecs in order of priority, overridden by VIDEO_CODECS
+	Encoder     string   `json:"encoder,omitempty"`    // audio only: ffmpeg encoder producing Opus
+	Resolution  string   `json:"resolution,omitempty"` // video only: WIDTHxHEIGHT of the highest quality step
+	Framerate   int      `json:"framerate,omitempty"`  // video only: frames per second of the highest quality step
+	Bitrate     string   `json:"bitrate,omitempty"`    // bits per second in ffmpeg notation, e.g. 1.5M or 48k
+	ExtraArgs   []string `json:"extraArgs,omitempty"`  // ffmpeg arguments after the encoder
+	Ingest      string   `json:"ingest,omitempty"`     // HOST:PORT receiving the RTP of ffmpeg or the external producer, for a speaker the RTP sent to ffmpeg, port 0 picks a free port
+}
+
+// Set contains all profiles of a profile file
+type Set struct {
+	Video   []Profile `json:"video"`
+	Audio   []Profile `json:"audio"`
+	Speaker []Profile `json:"speaker"`
+}
+
+// Load reads and validates the profile file at path, the embedded default profiles are used if path is empty
+func Load(path string) (*Set, error) {
+	data := defaultProfiles
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read profile file: %w", err)
+		}
+	}
+
+	var set Set
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse profile file: %w", err)
+	}
+
+	for i := range set.Video {
+		set.Video[i].Kind = KindVideo
+	}
+	for i := range set.Audio {
+		set.Audio[i].Kind = KindAudio
+	}
+
+	// Profile files written before speakers were supported get the built-in speaker profiles
+	if len(set.Speaker) == 0 && path != "" {
+		defaults, err := Load("")
+		if err != nil {
+			return nil, err
+		}
+		set.Speaker = defaults.Speaker
+	}
+	for i := range set.Speaker {
+		set.Speaker[i].Kind = KindSpeaker
+	}
+
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// Find returns the profile of the kind with the given name
+func (s *Set) Find(kind, name string) (Profile, error) {
+	for _, profile := range s.list(kind) {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("unknown %s profile %q", kind, name)
+}
+
+// Profiles returns all profiles of the kind
+func (s *Set) Profiles(kind string) []Profile {
+	return append([]Profile{}, s.list(kind)...)
+}
+
+func (s *Set) list(kind string) []Profile {
+	switch kind {
+	case KindVideo:
+		return s.Video
+	case KindSpeaker:
+		return s.Speaker
+	}
+	return s.Audio
+}
+
+// Selected loads PROFILES_FILE and returns the profile of the kind selected by VIDEO_PROFILE, AUDIO_PROFILE or SPEAKER_PROFILE.
+// The former VIDEO_MODE and AUDIO_MODE are still accepted, an unknown mode selects the default profile like before.
+func Selected(kind string) (Profile, error) {
+	set, err := Load(os.Getenv("PROFILES_FILE"))
+	if err != nil {
+		return Profile{}, err
+	}
+
+	prefix := strings.ToUpper(kind)
+	profile, err := set.Find(kind, defaultNames[kind])
+	if name := os.Getenv(prefix + "_PROFILE"); name != "" {
+		profile, err = set.Find(kind, name)
+	} else if mode := os.Getenv(prefix + "_MODE"); mode != "" {
+		if modeProfile, modeErr := set.Find(kind, mode); modeErr == nil {
+			profile, err = modeProfile, nil
+		}
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+
+	// The ingest address can differ between controllers sharing a profile file
+	if ingest := os.Getenv(prefix + "_INGEST"); ingest != "" {
+		profile.Ingest = ingest
+		if err := profile.Validate(); err != nil {
+			return Profile{}, fmt.Errorf("invalid %s_INGEST: %w", prefix, err)
+		}
+	}
+	return profile, nil
+}
+
+// validate checks all profiles of the set
+func (s *Set) validate() error {
+	var errs []error
+	for _, kind := range []string{KindVideo, KindAudio, KindSpeaker} {
+		names := make(map[string]bool)
+		for _, profile := range s.list(kind) {
+			if names[profile.Name] {
+				errs = append(errs, fmt.Errorf("duplicate %s profile %q", kind, profile.Name))
+			}
+			names[profile.Name] = true
+
+			if err := profile.Validate(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the fields of the profile
+func (p Profile) Validate() error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%s profile %q: %s", p.Kind, p.Name, fmt.Sprintf(format, args...))
+	}
+
+	if p.Name == "" {
+		return fail("name is missing")
+	}
+
+	switch {
+	case p.Kind == KindSpeaker:
+		if p.Output == "" {
+			return fail("output is missing")
+		}
+	case p.Source == "" || p.Source == SourceFFmpeg:
+		if p.Input == "" {
+			return fail("input is missing")
+		}
+	case p.Source == SourceH264:
+		if p.Kind != KindVideo {
+			return fail("source %s is only supported for video", p.Source)
+		}
+		if p.Input == "" && p.Command == "" {
+			return fail("input or command is required")
+		}
+	case p.Source == SourceSynthetic:
+		// The sample is embedded, the other fields are ignored
+	case p.Source == SourceRTP:
+		// The producer has to know where to send to
+		if p.Ingest == "" {
+			return fail("ingest is required")
+		}
+	default:
+		return fail("unknown source %q", p.Source)
+	}
+
+	if p.Ingest != "" {
+		addr, err := p.IngestAddr()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if p.Source == SourceRTP && addr.Port == 0 {
+			return fail("ingest needs a fixed port for an external producer")
+		}
+	}
+
+	if p.Resolution != "" {
+		if _, _, err := p.Size(); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	if p.Framerate < 0 {
+		return fail("framerate must be positive")
+	}
+
+	if p.Bitrate != "" {
+		if _, err := p.BitsPerSecond(); err != nil {
+			return fail("%v", err)
+		}
+	}
+	return nil
+}
+
+// Size returns the width and height of the resolution
+func (p Profile) Size() (int, int, error) {
+	width, height, ok := strings.Cut(p.Resolution, "x")
+	w, errW := strconv.Atoi(width)
+	h, errH := strconv.Atoi(height)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid resolution %q, expected WIDTHxHEIGHT", p.Resolution)
+	}
+	return w, h, nil
+}
+
+// BitsPerSecond returns the bitrate in bits per second, the suffixes k and M are accepted like in ffmpeg
+func (p Profile) BitsPerSecond() (int, error) {
+	value, factor := p.Bitrate, 1.0
+	switch {
+	case strings.HasSuffix(value, "k"):
+		value, factor = strings.TrimSuffix(value, "k"), 1e3
+	case strings.HasSuffix(value, "M"):
+		value, factor = strings.TrimSuffix(value, "M"), 1e6
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", p.Bitrate)
+	}
+	return int(number * factor), nil
+}
+
+// IngestAddr returns the UDP address receiving the RTP of the pipeline, DefaultIngest if the profile does not name one
+func (p Profile) IngestAddr() (*net.UDPAddr, error) {
+	ingest := p.Ingest
+	if ingest == "" {
+		ingest = DefaultIngest
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", ingest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingest %q, expected HOST:PORT: %w", p.Ingest, err)
+	}
+	return addr, nil
+}
+
+// String returns a one line summary of the profile
+func (p Profile) String() string {
+	var details []string
+	switch p.Source {
+	case SourceH264:
+		details = append(details, "h264 pass-through")
+	case SourceSynthetic:
+		details = append(details, "synthetic")
+	case SourceRTP:
+		details = append(details, "external rtp")
+	}
+	if p.Format != "" {
+		details = append(details, p.Format)
+	}
+	if p.Input != "" {
+		details = append(details, p.Input)
+	} else if p.Output != "" {
+		details = append(details, p.Output)
+	} else if p.Command != "" {
+		details = append(details, p.Command)
+	}
+	if len(p.Codecs) > 0 {
+		details = append(details, strings.Join(p.Codecs, ","))
+	}
+	if p.Encoder != "" {
+		details = append(details, p.Encoder)
+	}
+	if p.Resolution != "" {
+		details = append(details, fmt.Sprintf("%s@%d", p.Resolution, p.Framerate))
+	}
+	if p.Bitrate != "" {
+		details = append(details, p.Bitrate)
+	}
+	if p.Ingest != "" {
+		details = append(details, "ingest "+p.Ingest)
+	}
+	return fmt.Sprintf("%s (%s): %s", p.Name, p.Description, strings.Join(details, " "))
+}
@@ -0,0 +1,96 @@
+package profiles
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestValidate checks the fields required by each source and the format of the optional fields
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		profile Profile
+		err     string // part of the expected error, empty if the profile is valid
+	}{
+		{"ffmpeg", Profile{Name: "cam", Kind: KindVideo, Input: "/dev/video0", Resolution: "640x480", Framerate: 30, Bitrate: "1.5M"}, ""},
+		{"missing name", Profile{Kind: KindVideo, Input: "/dev/video0"}, "name is missing"},
+		{"missing input", Profile{Name: "cam", Kind: KindVideo}, "input is missing"},
+		{"h264 command", Profile{Name: "pi", Kind: KindVideo, Source: SourceH264, Command: "libcamera-vid -o -"}, ""},
+		{"h264 without input", Profile{Name: "pi", Kind: KindVideo, Source: SourceH264}, "input or command is required"},
+		{"h264 audio", Profile{Name: "pi", Kind: KindAudio, Source: SourceH264, Input: "audio.h264"}, "only supported for video"},
+		{"synthetic", Profile{Name: "test", Kind: KindAudio, Source: SourceSynthetic}, ""},
+		{"rtp", Profile{Name: "external", Kind: KindVideo, Source: SourceRTP, Ingest: "0.0.0.0:5004"}, ""},
+		{"rtp without ingest", Profile{Name: "external", Kind: KindVideo, Source: SourceRTP}, "ingest is required"},
+		{"rtp with free port", Profile{Name: "external", Kind: KindVideo, Source: SourceRTP, Ingest: "0.0.0.0:0"}, "fixed port"},
+		{"unknown source", Profile{Name: "cam", Kind: KindVideo, Source: "gstreamer"}, "unknown source"},
+		{"invalid ingest", Profile{Name: "cam", Kind: KindVideo, Input: "/dev/video0", Ingest: "5004"}, "invalid ingest"},
+		{"invalid resolution", Profile{Name: "cam", Kind: KindVideo, Input: "/dev/video0", Resolution: "640"}, "invalid resolution"},
+		{"negative framerate", Profile{Name: "cam", Kind: KindVideo, Input: "/dev/video0", Framerate: -1}, "framerate must be positive"},
+		{"invalid bitrate", Profile{Name: "cam", Kind: KindVideo, Input: "/dev/video0", Bitrate: "fast"}, "invalid bitrate"},
+		{"speaker", Profile{Name: "linux", Kind: KindSpeaker, Format: "alsa", Output: "default"}, ""},
+		{"speaker without output", Profile{Name: "linux", Kind: KindSpeaker, Format: "alsa"}, "output is missing"},
+	} {
+		err := test.profile.Validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: expected error %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+// TestLoad checks the embedded profiles and the validation of a profile file
+func TestLoad(t *testing.T) {
+	if _, err := Load(""); err != nil {
+		t.Fatalf("embedded profiles are invalid: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(`{"video":[{"name":"cam","input":"/dev/video0"},{"name":"cam","input":"/dev/video1"}]}`), 0o644); err != nil {
+		t.Fatalf("failed to write profile file: %v", err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "duplicate video profile") {
+		t.Errorf("got %v, expected an error for the duplicate profile", err)
+	}
+}
+
+// TestSelected checks the selection by name, the legacy modes and the default profiles
+func TestSelected(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		kind    string
+		profile string // VIDEO_PROFILE, AUDIO_PROFILE or SPEAKER_PROFILE
+		mode    string // VIDEO_MODE or AUDIO_MODE
+		want    string // name of the selected profile, empty if an error is expected
+	}{
+		{"default video", KindVideo, "", "", "lavfi"},
+		{"default audio", KindAudio, "", "", "lavfi"},
+		{"default speaker", KindSpeaker, "", "", "test"},
+		{"profile", KindVideo, "linux", "", "linux"},
+		{"unknown profile", KindVideo, "missing", "", ""},
+		{"legacy mode", KindAudio, "", "windows-privat", "windows-privat"},
+		{"unknown legacy mode", KindVideo, "", "missing", "lavfi"},
+		{"profile before mode", KindVideo, "test", "linux", "test"},
+	} {
+		prefix := strings.ToUpper(test.kind)
+		t.Setenv("PROFILES_FILE", "")
+		t.Setenv(prefix+"_PROFILE", test.profile)
+		t.Setenv(prefix+"_MODE", test.mode)
+		t.Setenv(prefix+"_INGEST", "")
+
+		profile, err := Selected(test.kind)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("%s: selected %s, expected an error", test.name, profile.Name)
+		case test.want != "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case profile.Name != test.want:
+			t.Errorf("%s: selected %q, expected %q", test.name, profile.Name, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package serialcomm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Binary frames are encoded as COBS(payload + CRC16) followed by a single 0x00 delimiter.
+// COBS (consistent overhead byte stuffing) removes every 0x00 from the encoded data, so 0x00 always marks the end of a frame.
+// The CRC is CRC-16/CCITT-FALSE (polynomial 0x1021, initial value 0xFFFF) of the payload, appended big-endian.
+
+// frameDelimiter terminates every binary frame
+const frameDelimiter = 0x00
+
+// MaxFrameSize is the maximum payload size of a binary frame
+const MaxFrameSize = 1024
+
+// maxEncodedFrameSize is the size of the COBS encoded payload of MaxFrameSize with its CRC, without the delimiter
+const maxEncodedFrameSize = MaxFrameSize + 2 + (MaxFrameSize+2)/254 + 1
+
+// crc16 computes the CRC-16/CCITT-FALSE checksum of data
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeFrame returns the COBS encoded payload with CRC, terminated by the frame delimiter
+func encodeFrame(payload []byte) ([]byte, error) {
+	if len(payload) > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum of %d bytes", len(payload), MaxFrameSize)
+	}
+
+	crc := crc16(payload)
+	data := append(append([]byte{}, payload...), byte(crc>>8), byte(crc))
+
+	encoded := make([]byte, 0, len(data)+len(data)/254+2)
+	codeIndex := len(encoded)
+	encoded = append(encoded, 0) // placeholder for the first code byte
+	code := byte(1)
+
+	for _, b := range data {
+		if b == 0 {
+			encoded[codeIndex] = code
+			codeIndex = len(encoded)
+			encoded = append(encoded, 0)
+			code = 1
+			continue
+		}
+
+		encoded = append(encoded, b)
+		code++
+
+		if code == 0xFF {
+			encoded[codeIndex] = code
+			codeIndex = len(encoded)
+			encoded = append(encoded, 0)
+			code = 1
+		}
+	}
+
+	encoded[codeIndex] = code
+	return append(encoded, frameDelimiter), nil
+}
+
+// readFrame reads the next encoded frame without its delimiter. Data longer than maxEncodedFrameSize cannot be a frame,
+// it is dropped up to the next delimiter, so a noisy line or a device that never sends the delimiter cannot grow the buffer.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	dropped := 0
+	for {
+		chunk, err := reader.ReadSlice(frameDelimiter)
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+
+		if dropped == 0 && len(frame)+len(chunk) <= maxEncodedFrameSize+1 {
+			frame = append(frame, chunk...)
+		} else {
+			dropped += len(frame) + len(chunk)
+			frame = nil
+		}
+
+		// The chunk ends with the delimiter
+		if err == nil {
+			if dropped > 0 {
+				log.Printf("Dropping %d bytes of serial data exceeding the maximum frame size", dropped)
+				dropped = 0
+				continue
+			}
+			return frame[:len(frame)-1], nil
+		}
+	}
+}
+
+// decodeFrame decodes a COBS frame without delimiter and verifies its CRC
+func decodeFrame(encoded []byte) ([]byte, error) {
+	data := make([]byte, 0, len(encoded))
+
+	for i := 0; i < len(encoded); {
+		code := encoded[i]
+		if code == 0 {
+			return nil, errors.New("unexpected zero byte in frame")
+		}
+		i++
+
+		end := i + int(code) - 1
+		if end > len(encoded) {
+			return nil, errors.New("truncated frame")
+		}
+		data = append(data, encoded[i:end]...)
+		i = end
+
+		// A code of 0xFF is not followed by an implicit zero, neither is the last block
+		if code != 0xFF && i < len(encoded) {
+			data = append(data, 0)
+		}
+	}
+
+	if len(data) < 2 {
+		return nil, errors.New("frame too short")
+	}
+
+	payload := data[:len(data)-2]
+	crc := uint16(data[len(data)-2])<<8 | uint16(data[len(data)-1])
+	if crc16(payload) != crc {
+		return nil, errors.New("frame checksum mismatch")
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,172 @@
+package serialcomm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// TestCRC16 checks the CRC-16/CCITT-FALSE check value
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x29B1 {
+		t.Fatalf("crc16 is 0x%04X, expected 0x29B1", crc)
+	}
+}
+
+// TestFrameRoundTrip encodes and decodes payloads around the COBS block boundaries
+func TestFrameRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomPayload := func(size int) []byte {
+		payload := make([]byte, size)
+		random.Read(payload)
+		return payload
+	}
+
+	payloads := map[string][]byte{
+		"empty":     {},
+		"zero":      {0},
+		"zeros":     {0, 0, 0},
+		"no zeros":  bytes.Repeat([]byte{0x11}, 300),
+		"253 bytes": bytes.Repeat([]byte{0xFF}, 253),
+		"254 bytes": bytes.Repeat([]byte{0xFF}, 254),
+		"255 bytes": bytes.Repeat([]byte{0xFF}, 255),
+		"control":   {0x01, 0x00, 0x7F, 0x80, 0x00, 0xFF},
+		"random":    randomPayload(100),
+		"maximum":   randomPayload(MaxFrameSize),
+	}
+
+	for name, payload := range payloads {
+		frame, err := encodeFrame(payload)
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %v", name, err)
+		}
+		if index := bytes.IndexByte(frame, frameDelimiter); index != len(frame)-1 {
+			t.Fatalf("%s: delimiter at %d of %d bytes, expected only at the end", name, index, len(frame))
+		}
+
+		decoded, err := decodeFrame(frame[:len(frame)-1])
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", name, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("%s: decoded % x, expected % x", name, decoded, payload)
+		}
+	}
+}
+
+// TestFrameTooLarge checks that payloads above MaxFrameSize are rejected
+func TestFrameTooLarge(t *testing.T) {
+	if _, err := encodeFrame(make([]byte, MaxFrameSize+1)); err == nil {
+		t.Fatal("encoded a payload above the maximum frame size")
+	}
+}
+
+// TestCorruptFrame checks that every single corrupted byte of a frame is detected
+func TestCorruptFrame(t *testing.T) {
+	frame, err := encodeFrame([]byte("COMBO 10 0 0"))
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	encoded := frame[:len(frame)-1]
+
+	for i := range encoded {
+		for _, flip := range []byte{0x01, 0x80} {
+			corrupt := append([]byte{}, encoded...)
+			corrupt[i] ^= flip
+			if payload, err := decodeFrame(corrupt); err == nil {
+				t.Errorf("byte %d flipped by 0x%02X decoded as % x", i, flip, payload)
+			}
+		}
+	}
+
+	for name, corrupt := range map[string][]byte{
+		"empty":     {},
+		"truncated": encoded[:len(encoded)-1],
+		"text line": []byte("OK\n"),
+	} {
+		if _, err := decodeFrame(corrupt); err == nil {
+			t.Errorf("%s frame decoded", name)
+		}
+	}
+}
+
+// fakePort is a serial port reading from a reader
+type fakePort struct {
+	serial.Port
+	reader io.Reader
+}
+
+func (f *fakePort) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+// TestReadFrames checks that the read loop delivers valid frames and drops corrupt ones
+func TestReadFrames(t *testing.T) {
+	var input []byte
+	for _, payload := range [][]byte{{0x01, 0x00, 0x02}, []byte("corrupt"), {0x03}} {
+		frame, err := encodeFrame(payload)
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		if bytes.Equal(payload, []byte("corrupt")) {
+			frame[1] ^= 0x01
+		}
+		input = append(input, frame...)
+	}
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	p := newPort(&fakePort{reader: reader}, FramingCOBS)
+	frames := make(chan []byte, 3)
+	p.SetFrameCallback(func(payload []byte) { frames <- payload })
+
+	go writer.Write(input)
+
+	for _, expected := range [][]byte{{0x01, 0x00, 0x02}, {0x03}} {
+		select {
+		case payload := <-frames:
+			if !bytes.Equal(payload, expected) {
+				t.Fatalf("received % x, expected % x", payload, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("did not receive % x", expected)
+		}
+	}
+	select {
+	case payload := <-frames:
+		t.Fatalf("received unexpected frame % x", payload)
+	default:
+	}
+}
+
+// TestReadOversizedFrame checks that data exceeding the maximum frame size is dropped up to the next delimiter
+// and the following frame is read
+func TestReadOversizedFrame(t *testing.T) {
+	valid, err := encodeFrame(bytes.Repeat([]byte{0x01}, MaxFrameSize))
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	noise := bytes.Repeat([]byte{0x55}, 10*maxEncodedFrameSize)
+	input := append(append(append(noise, frameDelimiter), valid...), valid...)
+	reader := bufio.NewReader(bytes.NewReader(input))
+
+	for i := 0; i < 2; i++ {
+		frame, err := readFrame(reader)
+		if err != nil {
+			t.Fatalf("failed to read frame %d: %v", i, err)
+		}
+		if !bytes.Equal(frame, valid[:len(valid)-1]) {
+			t.Fatalf("frame %d has %d bytes, expected the frame of the maximum size", i, len(frame))
+		}
+	}
+	if _, err := readFrame(reader); err != io.EOF {
+		t.Fatalf("got %v after the last frame, expected EOF", err)
+	}
+}
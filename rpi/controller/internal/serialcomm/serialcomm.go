@@ -4,17 +4,38 @@ package serialcomm
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"sync"
 
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
+
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 )
 
+var (
+	bytesMetric       = metrics.NewCounterVec("controller_serial_bytes_total", "Bytes transferred over the serial port.", "direction")
+	writeErrorsMetric = metrics.NewCounter("controller_serial_write_errors_total", "Failed writes to the serial port.")
+)
+
+// Framing selects how messages are delimited on the serial port.
+type Framing int
+
+const (
+	// FramingText reads '\n' terminated lines, binary frames can still be sent.
+	FramingText Framing = iota
+	// FramingCOBS reads binary frames, see framing.go. The Arduino has to frame everything it sends,
+	// a text line is not a valid frame and is dropped together with the frame it runs into.
+	FramingCOBS
+)
+
 // Port wraps a serial connection to an Arduino.
 type Port struct {
-	port     serial.Port
-	callback func(string)
-	mu       sync.RWMutex
+	port          serial.Port
+	callback      func(string)
+	frameCallback func([]byte)
+	binary        bool // received frames are COBS encoded instead of '\n' terminated lines, see framing.go
+	mu            sync.RWMutex
 }
 
 // PortInfo represents detailed information about a serial port.
@@ -48,30 +69,36 @@ func GetPorts() ([]PortInfo, error) {
 }
 
 // New initializes and returns a Port connected to the specified serial port at the given baud rate.
-// Example: p, err := serialcomm.New("/dev/ttyACM0", 9600)
-func New(name string, baud int) (*Port, error) {
+// The framing is fixed before the read loop starts.
+// Example: p, err := serialcomm.New("/dev/ttyACM0", 9600, serialcomm.FramingText)
+func New(name string, baud int, framing Framing) (*Port, error) {
 	mode := &serial.Mode{BaudRate: baud}
 	s, err := serial.Open(name, mode)
 	if err != nil {
 		return nil, fmt.Errorf("opening serial port %s: %w", name, err)
 	}
 
-	p := &Port{port: s}
+	return newPort(s, framing), nil
+}
+
+// newPort wraps an open serial port and starts reading from it.
+func newPort(s serial.Port, framing Framing) *Port {
+	p := &Port{port: s, binary: framing == FramingCOBS}
 	go p.readLoop()
-	return p, nil
+	return p
 }
 
 // NewByVIDPID initializes and returns a Port using the serial port with the specified VID and PID at the given baud rate.
 // It queries the list of connected ports and picks the one matching the VID and PID.
-// Example: p, err := serialcomm.NewByVIDPID("2341", "0043", 9600)
-func NewByVIDPID(vid, pid string, baud int) (*Port, error) {
+// Example: p, err := serialcomm.NewByVIDPID("2341", "0043", 9600, serialcomm.FramingText)
+func NewByVIDPID(vid, pid string, baud int, framing Framing) (*Port, error) {
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
 		return nil, fmt.Errorf("listing detailed serial ports: %w", err)
 	}
 	for _, port := range ports {
 		if vid == port.VID && pid == port.PID {
-			return New(port.Name, baud)
+			return New(port.Name, baud, framing)
 		}
 	}
 	return nil, fmt.Errorf("no serial port found with VID %s and PID %s", vid, pid)
@@ -86,10 +113,41 @@ func (p *Port) SendData(data string) error {
 	}
 	// always append exactly '\n'
 	msg := data + "\n"
-	_, err := p.port.Write([]byte(msg))
+	return p.write([]byte(msg))
+}
+
+// SendFrame writes a binary frame (COBS encoded payload with CRC16 and 0x00 delimiter) to the serial port.
+func (p *Port) SendFrame(payload []byte) error {
+	frame, err := encodeFrame(payload)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.port == nil {
+		return fmt.Errorf("serial port not initialized")
+	}
+	return p.write(frame)
+}
+
+// write writes raw bytes to the serial port and records them in the metrics. The caller holds the read lock.
+func (p *Port) write(data []byte) error {
+	n, err := p.port.Write(data)
+	bytesMetric.With("out").Add(uint64(n))
+	if err != nil {
+		writeErrorsMetric.Inc()
+	}
 	return err
 }
 
+// SetFrameCallback sets a handler function that will be called whenever a valid binary frame is received.
+func (p *Port) SetFrameCallback(cb func([]byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frameCallback = cb
+}
+
 // SetDataCallback sets a handler function that will be called whenever data is received.
 func (p *Port) SetDataCallback(cb func(string)) {
 	p.mu.Lock()
@@ -109,15 +167,37 @@ func (p *Port) Close() error {
 	return err
 }
 
-// internal read loop: reads lines and invokes callback if set.
+// internal read loop: reads lines or binary frames and invokes the matching callback if set.
 func (p *Port) readLoop() {
 	reader := bufio.NewReader(p.port)
 	for {
+		if p.binary {
+			frame, err := readFrame(reader)
+			if err != nil {
+				// Stop reading on errors
+				return
+			}
+			bytesMetric.With("in").Add(uint64(len(frame) + 1))
+			payload, err := decodeFrame(frame)
+			if err != nil {
+				log.Printf("Dropping invalid serial frame: %v", err)
+				continue
+			}
+			p.mu.RLock()
+			cb := p.frameCallback
+			p.mu.RUnlock()
+			if cb != nil {
+				cb(payload)
+			}
+			continue
+		}
+
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			// Stop reading on errors
 			return
 		}
+		bytesMetric.With("in").Add(uint64(len(line)))
 		p.mu.RLock()
 		cb := p.callback
 		p.mu.RUnlock()
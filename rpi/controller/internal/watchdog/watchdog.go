@@ -0,0 +1,102 @@
+// Package watchdog triggers a failsafe when the control link of a session goes silent or is lost.
+package watchdog
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons passed to the failsafe callback.
+const (
+	ReasonTimeout      = "timeout"
+	ReasonDisconnected = "disconnected"
+)
+
+// minCheckInterval bounds how often the tracked session is checked, so a tiny timeout does not spin the loop
+const minCheckInterval = time.Millisecond
+
+// Watchdog tracks the last control message of the session in control.
+// Only the session that fed the watchdog last is tracked, so a handover to another session never triggers the failsafe.
+type Watchdog struct {
+	timeout    time.Duration
+	onFailsafe func(sessionID, reason string)
+	sessionID  string // session that fed the watchdog last, empty if none
+	lastFeed   time.Time
+	tripped    bool // true after the failsafe fired until the next feed
+	stopChan   chan struct{}
+	mu         sync.Mutex
+}
+
+// New creates and starts a watchdog, which calls onFailsafe when the tracked session sends nothing for timeout.
+// Example: w := watchdog.New(500*time.Millisecond, func(sessionID, reason string) { ... })
+func New(timeout time.Duration, onFailsafe func(sessionID, reason string)) *Watchdog {
+	w := &Watchdog{
+		timeout:    timeout,
+		onFailsafe: onFailsafe,
+		stopChan:   make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// Feed records a control message of the session and re-arms the watchdog.
+func (w *Watchdog) Feed(sessionID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sessionID = sessionID
+	w.lastFeed = time.Now()
+	w.tripped = false
+}
+
+// Lost triggers the failsafe immediately if the session is the tracked one, e.g. when its connection failed.
+func (w *Watchdog) Lost(sessionID string) {
+	w.mu.Lock()
+	if sessionID == "" || sessionID != w.sessionID {
+		w.mu.Unlock()
+		return
+	}
+	tripped := w.tripped
+	w.sessionID = ""
+	w.tripped = false
+	w.mu.Unlock()
+
+	// The failsafe was already sent because of a timeout
+	if tripped {
+		return
+	}
+	w.onFailsafe(sessionID, ReasonDisconnected)
+}
+
+// Stop stops the watchdog.
+func (w *Watchdog) Stop() {
+	close(w.stopChan)
+}
+
+// internal loop: checks the tracked session a few times per timeout.
+func (w *Watchdog) loop() {
+	interval := w.timeout / 5
+	if interval < minCheckInterval {
+		interval = minCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			expired := w.sessionID != "" && !w.tripped && now.Sub(w.lastFeed) >= w.timeout
+			if expired {
+				w.tripped = true
+			}
+			sessionID := w.sessionID
+			w.mu.Unlock()
+
+			if expired {
+				w.onFailsafe(sessionID, ReasonTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package watchdog
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout is the timeout of the watchdogs under test
+const testTimeout = 20 * time.Millisecond
+
+// failsafes records the calls of the failsafe callback
+type failsafes struct {
+	calls []string // "<session id> <reason>"
+	mutex sync.Mutex
+}
+
+func (f *failsafes) trigger(sessionID, reason string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, sessionID+" "+reason)
+}
+
+// expect checks the calls so far
+func (f *failsafes) expect(t *testing.T, expected ...string) {
+	t.Helper()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.calls) != len(expected) {
+		t.Fatalf("failsafe called with %q, expected %q", f.calls, expected)
+	}
+	for i := range expected {
+		if f.calls[i] != expected[i] {
+			t.Fatalf("failsafe called with %q, expected %q", f.calls, expected)
+		}
+	}
+}
+
+// TestTimeout checks that an idle session trips the failsafe once until it is fed again
+func TestTimeout(t *testing.T) {
+	f := &failsafes{}
+	w := New(testTimeout, f.trigger)
+	defer w.Stop()
+
+	// Nothing is tracked before the first feed
+	time.Sleep(3 * testTimeout)
+	f.expect(t)
+
+	w.Feed("a")
+	time.Sleep(5 * testTimeout)
+	f.expect(t, "a timeout")
+
+	w.Feed("a")
+	time.Sleep(5 * testTimeout)
+	f.expect(t, "a timeout", "a timeout")
+}
+
+// TestFeeding checks that a session fed within the timeout does not trip the failsafe
+func TestFeeding(t *testing.T) {
+	f := &failsafes{}
+	w := New(testTimeout, f.trigger)
+	defer w.Stop()
+
+	for i := 0; i < 20; i++ {
+		w.Feed("a")
+		time.Sleep(testTimeout / 4)
+	}
+	f.expect(t)
+}
+
+// TestHandover checks that only the session fed last is tracked
+func TestHandover(t *testing.T) {
+	f := &failsafes{}
+	w := New(time.Hour, f.trigger)
+	defer w.Stop()
+
+	w.Feed("a")
+	w.Feed("b")
+	w.Lost("a")
+	f.expect(t)
+
+	w.Lost("b")
+	f.expect(t, "b disconnected")
+
+	// A lost session is no longer tracked
+	w.Lost("b")
+	f.expect(t, "b disconnected")
+}
+
+// TestLostAfterTimeout checks that a session, which already tripped the failsafe by its timeout, does not trip it again when it is lost
+func TestLostAfterTimeout(t *testing.T) {
+	f := &failsafes{}
+	w := New(testTimeout, f.trigger)
+	defer w.Stop()
+
+	w.Feed("a")
+	time.Sleep(5 * testTimeout)
+	w.Lost("a")
+	f.expect(t, "a timeout")
+}
+
+// TestTinyTimeout checks that a timeout shorter than the check interval neither panics nor misses the timeout
+func TestTinyTimeout(t *testing.T) {
+	f := &failsafes{}
+	w := New(time.Nanosecond, f.trigger)
+	defer w.Stop()
+
+	w.Feed("a")
+	time.Sleep(20 * time.Millisecond)
+	f.expect(t, "a timeout")
+}
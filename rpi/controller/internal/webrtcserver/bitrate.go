@@ -0,0 +1,83 @@
+// Adaptive video bitrate: the congestion controller (Google congestion control on transport wide CC feedback of the client)
+// estimates the available bandwidth of every peer connection. All sessions share one video encoder,
+// so the lowest estimate of the sessions receiving video is fed into the quality ladder of the video handler.
+
+package webrtcserver
+
+import (
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/video"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+)
+
+// adaptInterval is the time between two estimates fed into the quality ladder
+const adaptInterval = time.Second
+
+// newBandwidthEstimator creates the congestion control interceptor, which hands the estimator of each new peer connection to the server
+func (s *Server) newBandwidthEstimator() (*cc.InterceptorFactory, error) {
+	// The highest step of the profile can exceed the default ladder, so the estimate is not capped
+	lowest, highest := video.Ladder[0], video.Ladder[len(video.Ladder)-1]
+
+	factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// The encoder follows the estimate, so packets are not paced but sent as they come
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(highest.Bitrate),
+			gcc.SendSideBWEMinBitrate(lowest.Bitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Called synchronously inside NewPeerConnection, which is serialized by peerConnectionMutex
+	factory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		s.pendingEstimator = estimator
+	})
+	return factory, nil
+}
+
+// adaptVideo feeds the lowest estimate of the sessions receiving video into the quality ladder
+func (s *Server) adaptVideo() {
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			if estimate, ok := s.videoEstimate(); ok {
+				s.videoHandler.SetTargetBitrate(estimate)
+			}
+		}
+	}
+}
+
+// videoEstimate returns the lowest bandwidth estimate of the connected sessions receiving video
+func (s *Server) videoEstimate() (int, bool) {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mutex.Unlock()
+
+	lowest, ok := 0, false
+	for _, sess := range sessions {
+		sess.mutex.Lock()
+		receiving := sess.connected && !sess.closed && sess.tracksOn["video"] && sess.estimator != nil
+		estimator := sess.estimator
+		sess.mutex.Unlock()
+
+		if !receiving {
+			continue
+		}
+		if estimate := estimator.GetTargetBitrate(); !ok || estimate < lowest {
+			lowest, ok = estimate, true
+		}
+	}
+	return lowest, ok
+}
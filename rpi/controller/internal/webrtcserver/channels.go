@@ -0,0 +1,279 @@
+// A session can have several named data channels, e.g. "control" (unordered, no retransmits) for joystick frames,
+// "telemetry" (unordered) and "files" (reliable), so stale control frames never queue behind a file transfer.
+// Channels created by the client are identified by their label. Channels registered with options containing an ID
+// are negotiated out-of-band: the server creates them for every session and the client has to create them with
+// {negotiated: true, id: <ID>} and the same reliability settings.
+// The first channel the client creates is the primary channel. SendData, SendDataTo and all protocol replies use it.
+// Messages of channels without own callbacks are delivered to the OnMessage callbacks of the server.
+
+package webrtcserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ChannelOptions configures a named data channel
+type ChannelOptions struct {
+	Unordered      bool    // the zero value is ordered like the default of the browser
+	MaxRetransmits *uint16 // nil means reliable
+	ID             *uint16 // if set, the channel is negotiated out-of-band with this id
+}
+
+// Channel is a named data channel, which exists once per session
+type Channel struct {
+	server          *Server
+	label           string
+	options         *ChannelOptions
+	callbacks       []func(sessionID, message string)
+	binaryCallbacks []func(sessionID string, data []byte)
+}
+
+// Channel returns the named data channel with the given label, registering it on first use.
+// Options are only needed for channels negotiated out-of-band, they must be set before sessions connect.
+func (s *Server) Channel(label string, options *ChannelOptions) *Channel {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	channel, ok := s.channels[label]
+	if !ok {
+		channel = &Channel{server: s, label: label}
+		s.channels[label] = channel
+	}
+
+	if options != nil {
+		channel.options = options
+	}
+	return channel
+}
+
+// Label returns the label of the channel
+func (c *Channel) Label() string {
+	return c.label
+}
+
+// OnMessage registers a callback function that will be executed when a new message is received on this channel.
+// Like the OnMessage callbacks of the server, only messages of the session in control are delivered.
+func (c *Channel) OnMessage(callback func(sessionID, message string)) {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+
+	c.callbacks = append(c.callbacks, callback)
+}
+
+// OnBinaryMessage registers a callback function that will be executed when a new binary message is received on this channel.
+func (c *Channel) OnBinaryMessage(callback func(sessionID string, data []byte)) {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+
+	c.binaryCallbacks = append(c.binaryCallbacks, callback)
+}
+
+// SendData broadcasts data through this channel of all sessions.
+// An error is returned if no session received the data.
+func (c *Channel) SendData(data string) error {
+	return c.broadcast([]byte(data), false)
+}
+
+// SendDataTo sends data through this channel of the session with the given id
+func (c *Channel) SendDataTo(sessionID, data string) error {
+	return c.sendTo(sessionID, []byte(data), false)
+}
+
+// SendBinary broadcasts binary data through this channel of all sessions.
+// An error is returned if no session received the data.
+func (c *Channel) SendBinary(data []byte) error {
+	return c.broadcast(data, true)
+}
+
+// SendBinaryTo sends binary data through this channel of the session with the given id
+func (c *Channel) SendBinaryTo(sessionID string, data []byte) error {
+	return c.sendTo(sessionID, data, true)
+}
+
+func (c *Channel) broadcast(data []byte, binary bool) error {
+	c.server.mutex.Lock()
+	sessions := make([]*Session, 0, len(c.server.sessions))
+	for _, sess := range c.server.sessions {
+		sessions = append(sessions, sess)
+	}
+	c.server.mutex.Unlock()
+
+	lastErr := fmt.Errorf("data channel %s is not available", c.label)
+	sent := 0
+	for _, sess := range sessions {
+		if err := sess.sendOn(c.label, data, binary); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+func (c *Channel) sendTo(sessionID string, data []byte, binary bool) error {
+	sess := c.server.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	return sess.sendOn(c.label, data, binary)
+}
+
+// createNegotiatedChannels creates the out-of-band negotiated channels for a new session
+func (s *Server) createNegotiatedChannels(sess *Session) error {
+	s.mutex.Lock()
+	var options []webrtc.DataChannelInit
+	var labels []string
+	for label, channel := range s.channels {
+		if channel.options == nil || channel.options.ID == nil {
+			continue
+		}
+
+		negotiated := true
+		ordered := !channel.options.Unordered
+		options = append(options, webrtc.DataChannelInit{
+			Ordered:        &ordered,
+			MaxRetransmits: channel.options.MaxRetransmits,
+			Negotiated:     &negotiated,
+			ID:             channel.options.ID,
+		})
+		labels = append(labels, label)
+	}
+	s.mutex.Unlock()
+
+	for i, label := range labels {
+		dc, err := sess.peerConnection.CreateDataChannel(label, &options[i])
+		if err != nil {
+			return fmt.Errorf("failed to create data channel %s: %w", label, err)
+		}
+		s.setupDataChannel(sess, dc, false)
+	}
+	return nil
+}
+
+// setupDataChannel registers the data channel in the session and handles its messages
+func (s *Server) setupDataChannel(sess *Session, dc *webrtc.DataChannel, inBand bool) {
+	fmt.Printf("New DataChannel %s %d for session %s\n", dc.Label(), dc.ID(), sess.id)
+
+	sess.mutex.Lock()
+	sess.dataChannels[dc.Label()] = dc
+	if inBand && sess.primaryLabel == "" {
+		sess.primaryLabel = dc.Label()
+	}
+	sess.mutex.Unlock()
+
+	// Handle incoming messages
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		sess.recordReceived(dc.Label(), msg)
+
+		// After dispatching, so a message claiming control already counts
+		defer s.notifyActivity(sess.id)
+
+		// Binary messages bypass the text protocols
+		if !msg.IsString {
+			s.dispatchBinary(sess, dc.Label(), msg.Data)
+			return
+		}
+
+		message := string(msg.Data)
+
+		// Media messages toggle the tracks of the sending session, see media.go
+		if strings.HasPrefix(message, mediaPrefix) {
+			s.handleMediaMessage(sess, message)
+			return
+		}
+
+		// Stats messages subscribe the sending session to the stats push, see stats.go
+		if strings.HasPrefix(message, statsPrefix) {
+			s.handleStatsMessage(sess, message)
+			return
+		}
+
+		// Talk messages switch push-to-talk of the sending session, see talk.go
+		if strings.HasPrefix(message, talkPrefix) {
+			s.handleTalkMessage(sess, message)
+			return
+		}
+
+		// Control protocol messages are handled by the arbiter, see control.go
+		if strings.HasPrefix(message, controlPrefix) {
+			s.control.handle(sess.id, message)
+			return
+		}
+
+		// Typed messages of registered types are dispatched to their handlers, see protocol.go
+		if typed, ok := parseMessage(msg.Data); ok && s.handleTypedMessage(sess, typed) {
+			return
+		}
+
+		// Messages of observers are dropped
+		if !s.control.allow(sess.id) {
+			return
+		}
+
+		// Call the callbacks of the channel or of the server (copy under lock to avoid holding lock while calling)
+		s.mutex.Lock()
+		var callbacks []func(string, string)
+		if channel, ok := s.channels[dc.Label()]; ok && len(channel.callbacks) > 0 {
+			callbacks = append(callbacks, channel.callbacks...)
+		} else {
+			callbacks = append(callbacks, s.messageCallbacks...)
+		}
+		s.mutex.Unlock()
+
+		for _, cb := range callbacks {
+			cb(sess.id, message)
+		}
+	})
+
+	dc.OnOpen(func() {
+		fmt.Printf("Data channel %s opened - session %s established\n", dc.Label(), sess.id)
+	})
+
+	dc.OnClose(func() {
+		fmt.Printf("Data channel %s closed - session %s\n", dc.Label(), sess.id)
+	})
+}
+
+// dispatchBinary delivers a binary message to the callbacks of its channel or of the server
+func (s *Server) dispatchBinary(sess *Session, label string, data []byte) {
+	// Messages of observers are dropped
+	if !s.control.allow(sess.id) {
+		return
+	}
+
+	s.mutex.Lock()
+	var callbacks []func(string, []byte)
+	if channel, ok := s.channels[label]; ok && len(channel.binaryCallbacks) > 0 {
+		callbacks = append(callbacks, channel.binaryCallbacks...)
+	} else {
+		callbacks = append(callbacks, s.binaryCallbacks...)
+	}
+	s.mutex.Unlock()
+
+	for _, cb := range callbacks {
+		cb(sess.id, data)
+	}
+}
+
+// notifyActivity calls the activity callbacks if the session is in control
+func (s *Server) notifyActivity(sessionID string) {
+	if s.control.state().Driver != sessionID {
+		return
+	}
+
+	s.mutex.Lock()
+	callbacks := append([]func(string){}, s.activityCallbacks...)
+	s.mutex.Unlock()
+
+	for _, cb := range callbacks {
+		cb(sessionID)
+	}
+}
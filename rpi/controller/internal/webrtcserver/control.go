@@ -0,0 +1,318 @@
+// Control arbitration: exactly one session (the driver) may have its data channel messages forwarded to OnMessage.
+// All other sessions are observers, their messages are dropped.
+//
+// Protocol over the data channel (client -> server):
+//   CONTROL REQUEST       ask for the control token
+//   CONTROL RELEASE       give the control token back (driver only)
+//   CONTROL GRANT <id>    hand the control token over to the session <id> (driver only)
+//   CONTROL DENY <id>     reject the pending request of the session <id> (driver only)
+//
+// Protocol over the data channel (server -> client):
+//   CONTROL GRANTED       this session is the driver now
+//   CONTROL REVOKED       this session is no longer the driver
+//   CONTROL REQUESTED <id> the session <id> asks the driver for the control token
+//   CONTROL DENIED        the request of this session was rejected
+//   CONTROL PENDING       the request of this session was forwarded to the driver
+//
+// On a fresh server, any message of a session claims the control token implicitly, so single client frontends keep working.
+// Once a driver had the token, only CONTROL REQUEST grants it until all sessions are closed,
+// so a revoked or idle driver does not take it back with its next message.
+// A driver that sends nothing for the idle timeout loses the token, which is then handed to a pending requester.
+
+package webrtcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlPrefix marks data channel messages that belong to the control protocol
+const controlPrefix = "CONTROL "
+
+// defaultDriverIdleTimeout is the time after which an idle driver loses the control token
+const defaultDriverIdleTimeout = 10 * time.Second
+
+// ControlState is a snapshot of the control arbitration
+type ControlState struct {
+	Driver  string `json:"driver"`
+	Pending string `json:"pending"`
+}
+
+type controlArbiter struct {
+	mutex       sync.Mutex
+	driver      string
+	pending     string
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	claimable   bool                            // a message claims the token implicitly, see allow
+	notify      func(sessionID, message string) // sends a control protocol message to a session
+	exists      func(sessionID string) bool     // reports whether a session is still connected
+	outbox      []controlNotification           // messages to send after the lock is released, see flush
+	flushMutex  sync.Mutex                      // keeps the messages in order while they are sent
+}
+
+// controlNotification is a control protocol message to a session
+type controlNotification struct {
+	sessionID string
+	message   string
+}
+
+func newControlArbiter(notify func(sessionID, message string), exists func(sessionID string) bool) *controlArbiter {
+	return &controlArbiter{
+		idleTimeout: defaultDriverIdleTimeout,
+		claimable:   true,
+		notify:      notify,
+		exists:      exists,
+	}
+}
+
+// state returns a snapshot of the control arbitration
+func (ca *controlArbiter) state() ControlState {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	return ControlState{Driver: ca.driver, Pending: ca.pending}
+}
+
+// allow reports whether a regular message of the session may be forwarded.
+// A message of the driver resets its idle timer, the first message of a fresh server claims the token.
+func (ca *controlArbiter) allow(sessionID string) bool {
+	defer ca.flush()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if ca.driver == "" && ca.claimable {
+		ca.setDriverLocked(sessionID)
+		return true
+	}
+
+	if ca.driver != sessionID {
+		return false
+	}
+
+	ca.resetIdleTimerLocked()
+	return true
+}
+
+// handle processes a control protocol message of the session
+func (ca *controlArbiter) handle(sessionID, message string) {
+	fields := strings.Fields(strings.TrimPrefix(message, controlPrefix))
+	if len(fields) == 0 {
+		return
+	}
+
+	defer ca.flush()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	switch fields[0] {
+	case "REQUEST":
+		switch {
+		case ca.driver == "" || ca.driver == sessionID:
+			ca.setDriverLocked(sessionID)
+		default:
+			ca.pending = sessionID
+			ca.send(sessionID, "PENDING")
+			ca.send(ca.driver, "REQUESTED "+sessionID)
+		}
+	case "RELEASE":
+		if ca.driver == sessionID {
+			ca.handoverLocked()
+		}
+	case "GRANT":
+		if ca.driver == sessionID && len(fields) == 2 && fields[1] != sessionID && ca.exists(fields[1]) {
+			if ca.pending == fields[1] {
+				ca.pending = ""
+			}
+			ca.setDriverLocked(fields[1])
+		}
+	case "DENY":
+		if ca.driver == sessionID && len(fields) == 2 && ca.pending == fields[1] {
+			ca.pending = ""
+			ca.send(fields[1], "DENIED")
+		}
+	}
+}
+
+// grant makes the session the driver, revoking the current driver
+func (ca *controlArbiter) grant(sessionID string) {
+	defer ca.flush()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if ca.pending == sessionID {
+		ca.pending = ""
+	}
+	ca.setDriverLocked(sessionID)
+}
+
+// revoke takes the control token from the current driver and hands it to a pending requester if any
+func (ca *controlArbiter) revoke() error {
+	defer ca.flush()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if ca.driver == "" {
+		return errors.New("no session is in control")
+	}
+
+	ca.handoverLocked()
+	return nil
+}
+
+// remove forgets a session, which has been closed. After the last session the token can be claimed implicitly again.
+func (ca *controlArbiter) remove(sessionID string, last bool) {
+	defer ca.flush()
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if last {
+		ca.claimable = true
+	}
+
+	if ca.pending == sessionID {
+		ca.pending = ""
+	}
+
+	if ca.driver == sessionID {
+		ca.driver = "" // do not notify a closed session
+		ca.handoverLocked()
+	}
+}
+
+// setIdleTimeout changes the idle timeout of the driver. A timeout of 0 disables it.
+func (ca *controlArbiter) setIdleTimeout(timeout time.Duration) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.idleTimeout = timeout
+	ca.resetIdleTimerLocked()
+}
+
+// handoverLocked revokes the current driver and grants the token to the pending requester
+func (ca *controlArbiter) handoverLocked() {
+	next := ca.pending
+	ca.pending = ""
+
+	if next == "" {
+		if ca.driver != "" {
+			ca.send(ca.driver, "REVOKED")
+		}
+		ca.driver = ""
+		ca.stopIdleTimerLocked()
+		return
+	}
+
+	ca.setDriverLocked(next)
+}
+
+// setDriverLocked makes the session the driver and notifies the previous and the new driver
+func (ca *controlArbiter) setDriverLocked(sessionID string) {
+	if ca.driver != "" && ca.driver != sessionID {
+		ca.send(ca.driver, "REVOKED")
+	}
+
+	fmt.Printf("Session %s is in control now\n", sessionID)
+	ca.driver = sessionID
+	ca.claimable = false
+	ca.send(sessionID, "GRANTED")
+	ca.resetIdleTimerLocked()
+}
+
+func (ca *controlArbiter) resetIdleTimerLocked() {
+	ca.stopIdleTimerLocked()
+
+	if ca.driver == "" || ca.idleTimeout <= 0 {
+		return
+	}
+
+	driver := ca.driver
+	ca.idleTimer = time.AfterFunc(ca.idleTimeout, func() {
+		defer ca.flush()
+		ca.mutex.Lock()
+		defer ca.mutex.Unlock()
+
+		// Only the driver of this timer may be revoked, it may have changed in the meantime
+		if ca.driver != driver {
+			return
+		}
+
+		fmt.Printf("Session %s lost control (idle)\n", driver)
+		ca.handoverLocked()
+	})
+}
+
+func (ca *controlArbiter) stopIdleTimerLocked() {
+	if ca.idleTimer != nil {
+		ca.idleTimer.Stop()
+		ca.idleTimer = nil
+	}
+}
+
+// send queues a control protocol message, the caller holds the lock and flushes the queue after releasing it
+func (ca *controlArbiter) send(sessionID, message string) {
+	ca.outbox = append(ca.outbox, controlNotification{sessionID: sessionID, message: controlPrefix + message})
+}
+
+// flush sends the queued messages in the order they were queued, the arbiter lock is never held while sending
+func (ca *controlArbiter) flush() {
+	ca.flushMutex.Lock()
+	defer ca.flushMutex.Unlock()
+
+	ca.mutex.Lock()
+	outbox := ca.outbox
+	ca.outbox = nil
+	ca.mutex.Unlock()
+
+	for _, notification := range outbox {
+		ca.notify(notification.sessionID, notification.message)
+	}
+}
+
+// ControlState returns the current driver and pending requester
+func (s *Server) ControlState() ControlState {
+	return s.control.state()
+}
+
+// GrantControl makes the session with the given id the driver
+func (s *Server) GrantControl(sessionID string) error {
+	if s.session(sessionID) == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	s.control.grant(sessionID)
+	return nil
+}
+
+// RevokeControl takes the control token from the current driver
+func (s *Server) RevokeControl() error {
+	return s.control.revoke()
+}
+
+// SetDriverIdleTimeout sets the time after which an idle driver loses the control token. A timeout of 0 disables it.
+func (s *Server) SetDriverIdleTimeout(timeout time.Duration) {
+	s.control.setIdleTimeout(timeout)
+}
+
+// handleControl returns the control state on GET and force-revokes the driver on DELETE
+func (s *Server) handleControl(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		if err := s.RevokeControl(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ControlState())
+}
@@ -0,0 +1,75 @@
+package webrtcserver
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestControlOrder checks that the notifications of consecutive handovers reach the sessions in the order they happened
+func TestControlOrder(t *testing.T) {
+	var mutex sync.Mutex
+	received := map[string][]string{}
+	ca := newControlArbiter(func(sessionID, message string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received[sessionID] = append(received[sessionID], message)
+	}, func(sessionID string) bool {
+		return true
+	})
+	ca.setIdleTimeout(0)
+
+	var expected []string
+	ca.handle("a", "CONTROL REQUEST")
+	expected = append(expected, "CONTROL GRANTED")
+	for i := 0; i < 100; i++ {
+		ca.handle("b", "CONTROL REQUEST")
+		ca.handle("a", "CONTROL GRANT b")
+		ca.handle("b", "CONTROL RELEASE")
+		ca.handle("a", "CONTROL REQUEST")
+		expected = append(expected, "CONTROL REQUESTED b", "CONTROL REVOKED", "CONTROL GRANTED")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Equal(received["a"], expected) {
+		t.Fatalf("driver received %d messages out of order, expected %d:\n%v", len(received["a"]), len(expected), received["a"])
+	}
+}
+
+// TestControlAfterRevoke checks that neither the revoked driver nor an observer claims the token with a regular message,
+// it is only granted on request until all sessions are closed
+func TestControlAfterRevoke(t *testing.T) {
+	ca := newControlArbiter(func(sessionID, message string) {}, func(sessionID string) bool {
+		return true
+	})
+	ca.setIdleTimeout(0)
+
+	if !ca.allow("a") {
+		t.Fatal("first message of a fresh server was refused")
+	}
+	if err := ca.revoke(); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+
+	for _, sessionID := range []string{"a", "b"} {
+		if ca.allow(sessionID) {
+			t.Errorf("message of %s claimed the revoked token", sessionID)
+		}
+	}
+	if driver := ca.state().Driver; driver != "" {
+		t.Fatalf("%s is in control after the revoke", driver)
+	}
+
+	ca.handle("b", "CONTROL REQUEST")
+	if !ca.allow("b") || ca.allow("a") {
+		t.Fatal("only the requester has to be in control")
+	}
+
+	// A fresh start once all sessions are closed
+	ca.remove("b", false)
+	ca.remove("a", true)
+	if !ca.allow("c") {
+		t.Error("first message after the last session was refused")
+	}
+}
@@ -0,0 +1,438 @@
+package webrtcserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// TestSession connects a client, exchanges data channel messages in both directions and receives the synthetic video and audio
+func TestSession(t *testing.T) {
+	ts := startServer(t)
+	client := connect(t, ts)
+
+	if !ts.hasSession(t, client.sessionID) {
+		t.Fatalf("session %s is not listed", client.sessionID)
+	}
+
+	// The first message of the only session claims control implicitly and is delivered
+	client.send(t, "hello")
+	waitFor(t, "message of the client", func() bool {
+		return ts.received(client.sessionID, "hello")
+	})
+	client.expectMessage(t, "CONTROL GRANTED")
+
+	if err := ts.SendDataTo(client.sessionID, "ping"); err != nil {
+		t.Fatalf("failed to send to the session: %v", err)
+	}
+	client.expectMessage(t, "ping")
+
+	client.expectMedia(t)
+}
+
+// TestInvalidOffer checks that processOffer rejects an offer without creating a session
+func TestInvalidOffer(t *testing.T) {
+	ts := startServer(t)
+
+	for name, request := range map[string]webrtcserver.SDPRequest{
+		"answer type": {Type: "answer", SDP: "v=0\r\n"},
+		"invalid SDP": {Type: "offer", SDP: "invalid"},
+	} {
+		answer, status := postOffer(t, ts, request)
+		if status != http.StatusBadRequest || answer.Error == "" {
+			t.Errorf("%s: got status %d and error %q, expected status 400 with an error", name, status, answer.Error)
+		}
+	}
+
+	if sessions := ts.Sessions(); len(sessions) != 0 {
+		t.Errorf("rejected offers left %d sessions", len(sessions))
+	}
+}
+
+// TestSecondClient checks that a new offer does not close the existing session, both clients receive the media
+func TestSecondClient(t *testing.T) {
+	ts := startServer(t)
+	first := connect(t, ts)
+	first.send(t, "first")
+	first.expectMessage(t, "CONTROL GRANTED")
+
+	second := connect(t, ts)
+	if first.sessionID == second.sessionID {
+		t.Fatal("both clients got the same session")
+	}
+	if !ts.hasSession(t, first.sessionID) || !ts.hasSession(t, second.sessionID) {
+		t.Fatal("both sessions have to be listed")
+	}
+
+	// The second client joins the running pipelines
+	first.expectMedia(t)
+	second.expectMedia(t)
+
+	// Only the driver is delivered, the second client is an observer and has to ask for control.
+	// The data channel is ordered, so the message was handled once the request is answered.
+	second.send(t, "observer")
+	second.send(t, "CONTROL REQUEST")
+	second.expectMessage(t, "CONTROL PENDING")
+	first.expectMessage(t, "CONTROL REQUESTED "+second.sessionID)
+	if ts.received(second.sessionID, "observer") {
+		t.Error("message of the observer was delivered")
+	}
+}
+
+// TestReconnect checks that the session of a closed client is removed with its control token
+// and that a reconnecting client gets a new session and restarted media
+func TestReconnect(t *testing.T) {
+	ts := startServer(t)
+	first := connect(t, ts)
+	first.send(t, "first")
+	first.expectMessage(t, "CONTROL GRANTED")
+	first.expectMedia(t)
+
+	first.close(t)
+	waitFor(t, "session of the closed client to be removed", func() bool {
+		return !ts.hasSession(t, first.sessionID)
+	})
+	if ts.IsConnected() {
+		t.Fatal("server is connected without clients")
+	}
+
+	// The media pipelines stopped with the last client and start again for the new one
+	second := connect(t, ts)
+	if second.sessionID == first.sessionID {
+		t.Fatal("reconnecting client got the session of the closed one")
+	}
+	second.send(t, "second")
+	waitFor(t, "message of the reconnected client", func() bool {
+		return ts.received(second.sessionID, "second")
+	})
+	second.expectMessage(t, "CONTROL GRANTED")
+	second.expectMedia(t)
+}
+
+// TestRecording records the synthetic pipelines and reads the files back, so every frame has to be framed as IVF or Ogg
+func TestRecording(t *testing.T) {
+	ts := startServer(t)
+	client := connect(t, ts)
+
+	if _, err := ts.StartRecording(); err != nil {
+		t.Fatalf("failed to start recording: %v", err)
+	}
+	client.expectMedia(t)
+	state := ts.RecordingState()
+	if _, err := ts.StopRecording(); err != nil {
+		t.Fatalf("failed to stop recording: %v", err)
+	}
+
+	video, err := os.Open(filepath.Join(state.Directory, "video-vp8.ivf"))
+	if err != nil {
+		t.Fatalf("failed to open the video recording: %v", err)
+	}
+	defer video.Close()
+	ivf, header, err := ivfreader.NewWith(video)
+	if err != nil {
+		t.Fatalf("failed to read the IVF header: %v", err)
+	}
+	if header.FourCC != "VP80" {
+		t.Errorf("IVF FourCC is %q, expected VP80", header.FourCC)
+	}
+	frames := 0
+	for {
+		frame, _, err := ivf.ParseNextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read IVF frame %d: %v", frames, err)
+		}
+		if len(frame) == 0 {
+			t.Fatalf("IVF frame %d is empty", frames)
+		}
+		frames++
+	}
+	if frames < 10 {
+		t.Errorf("video recording has only %d frames", frames)
+	}
+
+	audio, err := os.Open(filepath.Join(state.Directory, "audio-opus.ogg"))
+	if err != nil {
+		t.Fatalf("failed to open the audio recording: %v", err)
+	}
+	defer audio.Close()
+	ogg, _, err := oggreader.NewWith(audio)
+	if err != nil {
+		t.Fatalf("failed to read the Ogg header: %v", err)
+	}
+	pages := 0
+	for {
+		_, _, err := ogg.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read Ogg page %d: %v", pages, err)
+		}
+		pages++
+	}
+	if pages < 10 {
+		t.Errorf("audio recording has only %d pages", pages)
+	}
+}
+
+// TestActivity checks that every kind of message of the session in control is reported as activity, but not those of observers
+func TestActivity(t *testing.T) {
+	ts := startServer(t)
+	webrtcserver.Handle(ts.Server, "ping", func(ctx context.Context, data struct{}) (any, error) {
+		return nil, nil
+	})
+
+	var mutex sync.Mutex
+	activity := map[string]int{}
+	ts.OnActivity(func(sessionID string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		activity[sessionID]++
+	})
+	count := func(sessionID string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return activity[sessionID]
+	}
+
+	driver := connect(t, ts)
+	observer := connect(t, ts)
+
+	driver.send(t, "CONTROL REQUEST")
+	driver.expectMessage(t, "CONTROL GRANTED")
+	waitFor(t, "control message to count", func() bool { return count(driver.sessionID) == 1 })
+
+	// Typed and media messages are not delivered to OnMessage, but keep the link alive
+	driver.send(t, `{"v":1,"type":"ping","seq":1,"ts":0}`)
+	waitFor(t, "typed message to count", func() bool { return count(driver.sessionID) == 2 })
+	driver.send(t, "MEDIA VIDEO ON")
+	waitFor(t, "media message to count", func() bool { return count(driver.sessionID) == 3 })
+
+	// The ordered data channel handled the message of the observer before answering the request
+	observer.send(t, "observer")
+	observer.send(t, "CONTROL REQUEST")
+	observer.expectMessage(t, "CONTROL PENDING")
+	if n := count(observer.sessionID); n != 0 {
+		t.Errorf("observer reported %d times as active", n)
+	}
+}
+
+// TestDuplicateResponse checks that a response sent twice does not block the messages of the session
+func TestDuplicateResponse(t *testing.T) {
+	ts := startServer(t)
+	client := connect(t, ts)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- ts.Request(context.Background(), client.sessionID, "status", nil, nil)
+	}()
+
+	// Answer the request twice
+	timeout := time.After(testTimeout)
+	for {
+		var request webrtcserver.Message
+		select {
+		case received := <-client.messages:
+			if json.Unmarshal([]byte(received), &request) != nil || request.Type != "status" {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("did not receive the request")
+		}
+
+		response, err := json.Marshal(webrtcserver.Message{Version: webrtcserver.ProtocolVersion, Type: "status", Seq: 1, ReplyTo: request.Seq})
+		if err != nil {
+			t.Fatalf("failed to encode response: %v", err)
+		}
+		client.send(t, string(response))
+		client.send(t, string(response))
+		break
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("request did not return")
+	}
+
+	// The receive loop of the session still runs
+	client.send(t, "after")
+	waitFor(t, "message after the duplicate response", func() bool {
+		return ts.received(client.sessionID, "after")
+	})
+}
+
+// TestMediaToggleBackToBack switches video and audio off and on again without waiting for the pipelines,
+// afterwards every pipeline has to play its source exactly once, a second loop would double the clock rate of the RTP
+func TestMediaToggleBackToBack(t *testing.T) {
+	ts := startServer(t)
+	client := connect(t, ts)
+
+	tracks := map[webrtc.RTPCodecType]*webrtc.TrackRemote{}
+	for len(tracks) < 2 {
+		select {
+		case track := <-client.tracks:
+			tracks[track.Kind()] = track
+		case <-time.After(testTimeout):
+			t.Fatal("did not receive the video and the audio track")
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		for _, kind := range []string{"VIDEO", "AUDIO"} {
+			client.send(t, "MEDIA "+kind+" OFF")
+			client.send(t, "MEDIA "+kind+" ON")
+		}
+	}
+
+	clockRates := map[webrtc.RTPCodecType]float64{
+		webrtc.RTPCodecTypeVideo: 90000,
+		webrtc.RTPCodecTypeAudio: 48000,
+	}
+
+	var wait sync.WaitGroup
+	rates := make(map[webrtc.RTPCodecType]float64)
+	var mutex sync.Mutex
+	for kind, track := range tracks {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			rate := timestampRate(track)
+			mutex.Lock()
+			rates[kind] = rate
+			mutex.Unlock()
+		}()
+	}
+	wait.Wait()
+
+	for kind, rate := range rates {
+		t.Logf("%s RTP timestamps advance by %.0f per second", kind, rate)
+		if ratio := rate / clockRates[kind]; ratio < 0.7 || ratio > 1.3 {
+			t.Errorf("%s RTP timestamps advance by %.0f per second, expected %.0f", kind, rate, clockRates[kind])
+		}
+	}
+}
+
+// timestampRate returns the RTP timestamp ticks per second of wall clock time. The backlog of the toggles is skipped,
+// only packets arriving after half a second are measured for a second.
+func timestampRate(track *webrtc.TrackRemote) float64 {
+	track.SetReadDeadline(time.Now().Add(testTimeout))
+
+	start := time.Now()
+	var first, last *rtp.Packet
+	var firstTime, lastTime time.Time
+	for time.Since(start) < 1500*time.Millisecond {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return 0
+		}
+		now := time.Now()
+		if now.Sub(start) < 500*time.Millisecond {
+			continue
+		}
+		if first == nil {
+			first, firstTime = packet, now
+		}
+		last, lastTime = packet, now
+	}
+
+	if first == nil || !lastTime.After(firstTime) {
+		return 0
+	}
+	return float64(last.Timestamp-first.Timestamp) / lastTime.Sub(firstTime).Seconds()
+}
+
+// TestStatsSubscription checks that the stats are only pushed to a client after it subscribed to them
+func TestStatsSubscription(t *testing.T) {
+	ts := startServer(t)
+	client := connect(t, ts)
+
+	isStats := func(message string) bool {
+		var msg webrtcserver.Message
+		return json.Unmarshal([]byte(message), &msg) == nil && msg.Type == "stats"
+	}
+
+	// Longer than the interval of the stats collector
+	timeout := time.After(3 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case received := <-client.messages:
+			if isStats(received) {
+				t.Fatal("stats were pushed without subscription")
+			}
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	client.send(t, "STATS ON")
+	client.expectMessage(t, "STATS ON")
+	timeout = time.After(testTimeout)
+	for {
+		select {
+		case received := <-client.messages:
+			if isStats(received) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("did not receive stats after the subscription")
+		}
+	}
+}
+
+// TestSessionMetrics checks that the session gauges count the sessions of all servers until they are closed
+func TestSessionMetrics(t *testing.T) {
+	first := startServer(t)
+	second := startServer(t)
+	connect(t, first)
+
+	sessions := func() string {
+		response, err := http.Get(second.url + "/metrics")
+		if err != nil {
+			t.Fatalf("failed to get metrics: %v", err)
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("failed to read metrics: %v", err)
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			if value, ok := strings.CutPrefix(line, "controller_sessions "); ok {
+				return value
+			}
+		}
+		return ""
+	}
+
+	if value := sessions(); value != "1" {
+		t.Fatalf("controller_sessions is %q with a session on the first server, expected 1", value)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("failed to close the first server: %v", err)
+	}
+	if value := sessions(); value != "0" {
+		t.Fatalf("controller_sessions is %q after closing the first server, expected 0", value)
+	}
+}
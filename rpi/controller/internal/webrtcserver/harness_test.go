@@ -0,0 +1,308 @@
+// End-to-end test harness: starts a server with the synthetic media sources on a free port
+// and connects pion clients through /api/offer like the web component does.
+
+package webrtcserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// testTimeout bounds every wait of the harness
+const testTimeout = 10 * time.Second
+
+// testServer is a server listening on a free port of the loopback interface
+type testServer struct {
+	*webrtcserver.Server
+	url string
+
+	mutex    sync.Mutex
+	messages []receivedMessage // messages passed to OnMessage
+}
+
+// receivedMessage is a message delivered to OnMessage
+type receivedMessage struct {
+	sessionID string
+	message   string
+}
+
+// startServer starts a server with video and audio of the built-in synthetic profiles, so neither ffmpeg nor devices are needed
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+
+	t.Setenv("PROFILES_FILE", "")
+	t.Setenv("VIDEO_PROFILE", "test")
+	t.Setenv("AUDIO_PROFILE", "test")
+	t.Setenv("SPEAKER_PROFILE", "test")
+	t.Setenv("VIDEO_CODECS", "")
+	t.Setenv("RECORD_DIR", t.TempDir())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ts := &testServer{
+		Server: webrtcserver.NewWithListener(listener, true, true),
+		url:    "http://" + listener.Addr().String(),
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	ts.OnMessage(func(sessionID, message string) {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		ts.messages = append(ts.messages, receivedMessage{sessionID: sessionID, message: message})
+	})
+
+	return ts
+}
+
+// received reports whether OnMessage got the message from the session
+func (ts *testServer) received(sessionID, message string) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, received := range ts.messages {
+		if received.sessionID == sessionID && received.message == message {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSession reports whether the session is listed by /api/sessions
+func (ts *testServer) hasSession(t *testing.T, sessionID string) bool {
+	t.Helper()
+
+	response, err := http.Get(ts.url + "/api/sessions")
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	defer response.Body.Close()
+
+	var sessions []webrtcserver.SessionInfo
+	if err := json.NewDecoder(response.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// testClient is a pion peer receiving video and audio with a data channel, like the web component
+type testClient struct {
+	pc        *webrtc.PeerConnection
+	dc        *webrtc.DataChannel
+	sessionID string
+	open      chan struct{}
+	tracks    chan *webrtc.TrackRemote
+	messages  chan string
+}
+
+// connect sends the offer of a new client to /api/offer and applies the answer
+func connect(t *testing.T, ts *testServer) *testClient {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create peer connection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	c := &testClient{
+		pc:       pc,
+		open:     make(chan struct{}),
+		tracks:   make(chan *webrtc.TrackRemote, 2),
+		messages: make(chan string, 100),
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatalf("failed to add %s transceiver: %v", kind, err)
+		}
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		c.tracks <- track
+	})
+
+	c.dc, err = pc.CreateDataChannel("data", nil)
+	if err != nil {
+		t.Fatalf("failed to create data channel: %v", err)
+	}
+	c.dc.OnOpen(func() { close(c.open) })
+	c.dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString {
+			select {
+			case c.messages <- string(msg.Data):
+			default: // the test does not read every message
+			}
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set local description: %v", err)
+	}
+	<-gatherComplete
+
+	answer, status := postOffer(t, ts, webrtcserver.SDPRequest{Type: "offer", SDP: pc.LocalDescription().SDP})
+	if status != http.StatusOK {
+		t.Fatalf("offer rejected with status %d: %s", status, answer.Error)
+	}
+	if answer.SessionID == "" {
+		t.Fatal("answer has no session id")
+	}
+	c.sessionID = answer.SessionID
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatalf("failed to set remote description: %v", err)
+	}
+
+	select {
+	case <-c.open:
+	case <-time.After(testTimeout):
+		t.Fatal("data channel did not open")
+	}
+	return c
+}
+
+// postOffer posts the request to /api/offer and returns the decoded response and its status code
+func postOffer(t *testing.T, ts *testServer, request webrtcserver.SDPRequest) (webrtcserver.SDPResponse, int) {
+	t.Helper()
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("failed to encode offer: %v", err)
+	}
+	response, err := http.Post(ts.url+"/api/offer", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post offer: %v", err)
+	}
+	defer response.Body.Close()
+
+	var answer webrtcserver.SDPResponse
+	if err := json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		t.Fatalf("failed to decode answer: %v", err)
+	}
+	return answer, response.StatusCode
+}
+
+// send sends a text message over the data channel
+func (c *testClient) send(t *testing.T, message string) {
+	t.Helper()
+
+	if err := c.dc.SendText(message); err != nil {
+		t.Fatalf("failed to send %q: %v", message, err)
+	}
+}
+
+// expectMessage waits for a data channel message, other messages (e.g. control notifications) are skipped
+func (c *testClient) expectMessage(t *testing.T, message string) {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case received := <-c.messages:
+			if received == message {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("did not receive %q", message)
+		}
+	}
+}
+
+// expectMedia waits for the video and the audio track and checks the RTP of both
+func (c *testClient) expectMedia(t *testing.T) {
+	t.Helper()
+
+	// The clock ticks of one frame of the synthetic samples: 30 fps video at 90 kHz, 20 ms Opus at 48 kHz
+	step := map[webrtc.RTPCodecType]uint32{
+		webrtc.RTPCodecTypeVideo: 3000,
+		webrtc.RTPCodecTypeAudio: 960,
+	}
+
+	for range step {
+		select {
+		case track := <-c.tracks:
+			expectRTP(t, track, step[track.Kind()])
+		case <-time.After(testTimeout):
+			t.Fatal("did not receive the video and the audio track")
+		}
+	}
+}
+
+// expectRTP reads RTP from the track for a second and checks that its timestamps advance by one frame at a time
+func expectRTP(t *testing.T, track *webrtc.TrackRemote, step uint32) {
+	t.Helper()
+
+	var previous *rtp.Packet
+	frames := 0
+	track.SetReadDeadline(time.Now().Add(testTimeout))
+	for start := time.Now(); time.Since(start) < time.Second; {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			t.Fatalf("failed to read %s RTP: %v", track.Kind(), err)
+		}
+		if len(packet.Payload) == 0 {
+			t.Fatalf("%s RTP packet without payload", track.Kind())
+		}
+
+		if previous != nil {
+			if packet.SequenceNumber != previous.SequenceNumber+1 {
+				t.Fatalf("%s RTP sequence number %d follows %d", track.Kind(), packet.SequenceNumber, previous.SequenceNumber)
+			}
+			if delta := packet.Timestamp - previous.Timestamp; delta != 0 {
+				if delta != step {
+					t.Fatalf("%s RTP timestamp advanced by %d, expected %d", track.Kind(), delta, step)
+				}
+				frames++
+			}
+		}
+		previous = packet
+	}
+
+	if frames < 10 {
+		t.Fatalf("received only %d %s frames", frames, track.Kind())
+	}
+	t.Logf("received %d %s frames of %s", frames, track.Kind(), track.Codec().MimeType)
+}
+
+// close closes the peer connection of the client
+func (c *testClient) close(t *testing.T) {
+	t.Helper()
+
+	if err := c.pc.Close(); err != nil {
+		t.Fatalf("failed to close peer connection: %v", err)
+	}
+}
+
+// waitFor polls the condition until it is true
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -8,192 +8,238 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/profiles"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/supervisor"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/synthetic"
+
 	"github.com/pion/webrtc/v4"
 )
 
-const udpPort = 5006
+var (
+	packetsMetric  = metrics.NewCounterVec("controller_rtp_packets_forwarded_total", "RTP packets forwarded from ffmpeg to the WebRTC track.", "kind").With("audio")
+	restartsMetric = metrics.NewCounterVec("controller_ffmpeg_restarts_total", "Restarts of the ffmpeg pipeline after its first start.", "kind").With("audio")
+)
 
 // Handler manages the audio streaming functionality
 type Handler struct {
-	audioTrack  *webrtc.TrackLocalStaticRTP
-	stopChan    chan struct{}
+	profile     profiles.Profile
+	hub         *hub.Hub               // writes the stream of ffmpeg to the tracks of all sessions
+	tap         hub.Tap                // recording tap of the hub, nil if not recording
+	supervisor  *supervisor.Supervisor // runs ffmpeg, nil for the synthetic source and an external producer
+	synthetic   *synthetic.Source      // embedded sample instead of ffmpeg, nil otherwise
+	ingest      *net.UDPAddr           // address receiving the RTP of ffmpeg or an external producer, a free port is picked if its port is 0
+	conn        *net.UDPConn           // receives the RTP, opened with the first stream and kept, so a restart finds the port free
+	port        int                    // port the RTP is received on
+	onState     func(codec string, status supervisor.Status)
+	stopChan    chan struct{} // closed to stop the current stream, every start gets a new one
+	done        chan struct{} // closed when the goroutine of the last start ended
 	isStreaming bool
+	mutex       sync.Mutex
 }
 
-// NewHandler creates a new audio handler
+// NewHandler creates a new audio handler for the audio profile selected by AUDIO_PROFILE
 func NewHandler() *Handler {
-	return &Handler{
+	profile, err := profiles.Selected(profiles.KindAudio)
+	if err != nil {
+		log.Fatalf("failed to load audio profile: %v", err)
+	}
+	log.Printf("Using audio profile %s", profile)
+
+	ah := &Handler{
+		profile:  profile,
 		stopChan: make(chan struct{}),
 	}
-}
 
-// CreateTrack creates an audio track for WebRTC
-func (ah *Handler) CreateTrack() (*webrtc.TrackLocalStaticRTP, error) {
-	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
-		"audio",
-		"microphone",
-	)
+	// The synthetic source plays an embedded Opus sample, there is no process to supervise
+	if profile.Source == profiles.SourceSynthetic {
+		ah.synthetic, err = synthetic.Audio()
+		if err != nil {
+			log.Fatalf("failed to load synthetic audio: %v", err)
+		}
+		ah.hub = hub.New(ah.synthetic.Codec(), "audio", "microphone", true, nil)
+		return ah
+	}
+
+	ah.ingest, err = profile.IngestAddr()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create audio track: %w", err)
+		log.Fatalf("failed to configure audio ingest: %v", err)
+	}
+
+	// An external producer sends the RTP on its own, there is no process to supervise
+	ah.hub = hub.New(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "microphone", false, nil)
+	if profile.Source != profiles.SourceRTP {
+		ah.supervisor = supervisor.New("audio", ah.ffmpegCommand, ah.reportState)
 	}
-	ah.audioTrack = audioTrack
-	return audioTrack, nil
+	return ah
+}
+
+// OnState registers a callback function that will be executed when the state of the ffmpeg process changes.
+// The codec is the MIME type of the stream, "audio/opus".
+func (ah *Handler) OnState(callback func(codec string, status supervisor.Status)) {
+	ah.mutex.Lock()
+	defer ah.mutex.Unlock()
+
+	ah.onState = callback
+}
+
+// reportState counts restarts and passes the state of the ffmpeg process to the callback of the handler
+func (ah *Handler) reportState(status supervisor.Status) {
+	if status.State == supervisor.StateStarting && status.Attempt > 1 {
+		restartsMetric.Inc()
+	}
+
+	ah.mutex.Lock()
+	callback := ah.onState
+	ah.mutex.Unlock()
+
+	if callback != nil {
+		callback(ah.hub.Codec().MimeType, status)
+	}
+}
+
+// CreateTrack creates a new audio track for one session, ffmpeg runs once and feeds the tracks of all sessions.
+// Opus is supported by every browser, so the codecs offered by the client are not inspected.
+func (ah *Handler) CreateTrack(offered []string) (webrtc.TrackLocal, error) {
+	return ah.hub.NewTrack()
 }
 
-// StartStreaming starts the audio streaming process
-func (ah *Handler) StartStreaming() error {
+// StartStreaming starts sending the audio to the track, ffmpeg is started for the first track
+func (ah *Handler) StartStreaming(track webrtc.TrackLocal) error {
+	ah.mutex.Lock()
+	defer ah.mutex.Unlock()
+
+	if !ah.hub.Add(track) {
+		return nil
+	}
+
 	if ah.isStreaming {
 		return errors.New("audio streaming already in progress")
 	}
 
-	if ah.audioTrack == nil {
-		return errors.New("audio track not created")
+	stopChan := make(chan struct{})
+	ah.stopChan = stopChan
+	ah.isStreaming = true
+
+	stream := ah.streamAudio
+	if ah.synthetic != nil {
+		stream = ah.streamSynthetic
 	}
 
-	ah.stopChan = make(chan struct{})
-	ah.isStreaming = true
+	previous := ah.done
+	done := make(chan struct{})
+	ah.done = done
 
 	go func() {
-		if err := ah.streamAudio(); err != nil {
+		defer close(done)
+
+		// The stream of the previous start ends first, so two streams never write to the tracks at once
+		if previous != nil {
+			<-previous
+		}
+
+		if err := stream(stopChan); err != nil {
 			log.Printf("Audio streaming error: %v", err)
 		}
-		ah.isStreaming = false
+
+		// A stream stopped by StopStreaming may end after the next start, it must not reset the state of the new stream
+		ah.mutex.Lock()
+		defer ah.mutex.Unlock()
+		if ah.stopChan == stopChan && ah.isStreaming {
+			close(stopChan)
+			ah.isStreaming = false
+			if ah.supervisor != nil {
+				ah.supervisor.Stop()
+			}
+		}
 	}()
 
+	log.Printf("Started audio pipeline")
 	return nil
 }
 
-// StopStreaming stops the audio streaming process
-func (ah *Handler) StopStreaming() {
-	if ah.isStreaming {
+// StopStreaming stops sending the audio to the track, ffmpeg is stopped after the last track
+func (ah *Handler) StopStreaming(track webrtc.TrackLocal) {
+	ah.mutex.Lock()
+	defer ah.mutex.Unlock()
+
+	if ah.hub.Remove(track) && ah.isStreaming {
 		close(ah.stopChan)
 		ah.isStreaming = false
+		if ah.supervisor != nil {
+			ah.supervisor.Stop()
+		}
+		log.Printf("Stopped audio pipeline")
 	}
 }
 
-func (ah *Handler) streamAudio() error {
-	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
-	}
+// Record passes the stream to a tap created by newTap, a nil newTap stops passing the stream to the tap
+func (ah *Handler) Record(newTap func(codec webrtc.RTPCodecCapability) hub.Tap) {
+	ah.mutex.Lock()
+	defer ah.mutex.Unlock()
 
-	udpConn, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP port %d: %w", udpPort, err)
+	if ah.tap != nil {
+		ah.hub.RemoveTap(ah.tap)
+		ah.tap = nil
 	}
-	defer udpConn.Close()
+	if newTap != nil {
+		ah.tap = newTap(ah.hub.Codec())
+		ah.hub.AddTap(ah.tap)
+	}
+}
 
-	// Setup FFmpeg to capture directly from the camera and stream as RTP
-	var ffmpeg *exec.Cmd
+// RequestKeyframe does nothing, every Opus frame can be decoded on its own
+func (ah *Handler) RequestKeyframe(track webrtc.TrackLocal) {}
 
-	ffmpegBinary := os.Getenv("FFMPEG_BINARY")
-	if ffmpegBinary == "" {
-		ffmpegBinary = "ffmpeg"
+// streamSynthetic plays the embedded sample until streaming is stopped
+func (ah *Handler) streamSynthetic(stopChan chan struct{}) error {
+	return ah.synthetic.Play(ah.hub.WriteSample, stopChan)
+}
+
+// listen returns the UDP connection receiving the RTP, it is opened on first use
+func (ah *Handler) listen() (*net.UDPConn, error) {
+	ah.mutex.Lock()
+	defer ah.mutex.Unlock()
+
+	if ah.conn != nil {
+		return ah.conn, nil
 	}
 
-	ffmpegLogLevel := os.Getenv("FFMPEG_LOG_LEVEL")
-	if ffmpegLogLevel == "" {
-		ffmpegLogLevel = "error"
+	conn, err := net.ListenUDP("udp", ah.ingest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP address %s: %w", ah.ingest, err)
 	}
 
-	switch audioMode := os.Getenv("AUDIO_MODE"); audioMode {
-	case "linux": // LINUX
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",                   // removes version/config dump
-			"-nostats",                       // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "alsa", "-i", "plughw:3,0", // input device
-			"-c:a", "libopus", // use opus codec
-			"-frame_duration", "20", // 20ms frames
-			"-application", "voip", // Low-latency mode
-			"-b:a", "48k", // Bitrate
-			"-vn",       // Disable video
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "linux-work": // UBUNTU ARBEIT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",                   // removes version/config dump
-			"-nostats",                       // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "alsa", "-i", "plughw:1,0", // input device
-			"-c:a", "libopus", // use opus codec
-			"-frame_duration", "20", // 20ms frames
-			"-application", "voip", // Low-latency mode
-			"-b:a", "48k", // Bitrate
-			"-vn",       // Disable video
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "windows-work": // WINDOWS ARBEIT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",                                           // removes version/config dump
-			"-nostats",                                               // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "dshow", "-i", "audio=Mikrofon (Realtek(R) Audio)", // input device
-			"-c:a", "libopus", // use opus codec
-			"-frame_duration", "20", // 20ms frames
-			"-application", "voip", // Low-latency mode
-			"-b:a", "48k", // Bitrate
-			"-vn",       // Disable video
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "windows-privat": // WINDOWS PRIVAT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",                                                                                     // removes version/config dump
-			"-nostats",                                                                                         // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "dshow", "-i", "audio=Mikrofonarray (Intel® Smart Sound Technologie für digitale Mikrofone)", // input device
-			"-c:a", "libopus", // use opus codec
-			"-frame_duration", "20", // 20ms frames
-			"-application", "voip", // Low-latency mode
-			"-b:a", "48k", // Bitrate
-			"-vn",       // Disable video
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	default: // AUDIO
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner", // removes version/config dump
-			"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
-			"-re",          // realtime speed
-			"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000",
-			"-c:a", "libopus", // use opus codec
-			"-frame_duration", "20", // 20ms frames
-			"-application", "voip", // Low-latency mode
-			"-b:a", "48k", // Bitrate
-			"-vn",       // Disable video
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	}
-
-	ffmpeg.Stdout = io.Discard // all logs in ffmpeg go to stderr
-	ffmpeg.Stderr = log.Writer()
-
-	// Start the FFmpeg process
-	if err := ffmpeg.Start(); err != nil {
-		return fmt.Errorf("ffmpeg start error: %w", err)
-	}
-
-	// Setup cleanup to ensure ffmpeg process is terminated
-	go func() {
-		<-ah.stopChan
-		if err := ffmpeg.Process.Kill(); err != nil {
-			log.Printf("Error killing FFmpeg process: %v", err)
+	// A free port is only known after listening, ffmpeg is started afterwards and sends to it
+	ah.conn = conn
+	ah.port = conn.LocalAddr().(*net.UDPAddr).Port
+	log.Printf("Receiving audio RTP on %s", conn.LocalAddr())
+	return conn, nil
+}
+
+// streamAudio forwards the RTP received on the ingest address, which ffmpeg or an external producer sends
+func (ah *Handler) streamAudio(stopChan chan struct{}) error {
+	udpConn, err := ah.listen()
+	if err != nil {
+		return err
+	}
+
+	// The supervisor restarts ffmpeg when it exits or stalls. StopStreaming stops it under the same mutex,
+	// so a stopped stream cannot start it again.
+	if ah.supervisor != nil {
+		ah.mutex.Lock()
+		select {
+		case <-stopChan:
+		default:
+			ah.supervisor.Start()
 		}
-		udpConn.Close()
-	}()
+		ah.mutex.Unlock()
+	}
 
 	// Buffer for reading RTP packets (1500 bytes is typical MTU size)
 	buffer := make([]byte, 1500)
@@ -201,13 +247,13 @@ func (ah *Handler) streamAudio() error {
 	// Read RTP packets from UDP and forward to WebRTC
 	for {
 		select {
-		case <-ah.stopChan:
+		case <-stopChan:
 			return nil
 		default:
 			// Set read deadline to allow periodic stop checks
 			udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 
-			n, _, err := udpConn.ReadFrom(buffer)
+			n, addr, err := udpConn.ReadFrom(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -221,10 +267,67 @@ func (ah *Handler) streamAudio() error {
 				return fmt.Errorf("UDP read error: %w", err)
 			}
 
-			// Write raw RTP packet to WebRTC track
-			if _, err := ah.audioTrack.Write(buffer[:n]); err != nil {
-				return fmt.Errorf("RTP write error: %w", err)
+			// Write raw RTP packet to the tracks of all sessions, a stray datagram must not end the stream of the listeners
+			if err := ah.hub.Write(buffer[:n]); err != nil {
+				log.Printf("Dropped audio packet from %s: %v", addr, err)
+				continue
+			}
+			packetsMetric.Inc()
+			if ah.supervisor != nil {
+				ah.supervisor.Touch()
 			}
 		}
 	}
 }
+
+// ffmpegCommand creates the ffmpeg process of the profile, which sends the encoded audio as RTP to the ingest address
+func (ah *Handler) ffmpegCommand() *exec.Cmd {
+	ffmpegBinary := os.Getenv("FFMPEG_BINARY")
+	if ffmpegBinary == "" {
+		ffmpegBinary = "ffmpeg"
+	}
+
+	ffmpegLogLevel := os.Getenv("FFMPEG_LOG_LEVEL")
+	if ffmpegLogLevel == "" {
+		ffmpegLogLevel = "error"
+	}
+
+	profile := ah.profile
+
+	// An ingest address listening on all interfaces is reached on the loopback interface
+	host := "127.0.0.1"
+	if ah.ingest.IP != nil && !ah.ingest.IP.IsUnspecified() {
+		host = ah.ingest.IP.String()
+	}
+
+	encoder := profile.Encoder
+	if encoder == "" {
+		encoder = "libopus" // use opus codec
+	}
+
+	// Setup FFmpeg to capture the input of the profile and stream as RTP
+	args := []string{
+		"-loglevel", ffmpegLogLevel,
+		"-hide_banner", // removes version/config dump
+		"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
+	}
+	args = append(args, profile.InputArgs...)
+	if profile.Format != "" {
+		args = append(args, "-f", profile.Format) // input mode
+	}
+	args = append(args, "-i", profile.Input) // input device
+	args = append(args, "-c:a", encoder)
+	if profile.Bitrate != "" {
+		args = append(args, "-b:a", profile.Bitrate) // Bitrate
+	}
+	args = append(args, profile.ExtraArgs...)
+	args = append(args,
+		"-vn",       // Disable video
+		"-f", "rtp", // RTP output format
+		"rtp://"+net.JoinHostPort(host, strconv.Itoa(ah.port)), // output URL
+	)
+
+	ffmpeg := exec.Command(ffmpegBinary, args...)
+	ffmpeg.Stdout = io.Discard // all logs in ffmpeg go to stderr, which is read by the supervisor
+	return ffmpeg
+}
@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// continuity keeps the sequence numbers and timestamps of the tracks continuous when the encoder restarts, e.g. to force
+// a keyframe or change the quality. Every run of ffmpeg starts with a new SSRC and random sequence numbers and timestamps,
+// the tracks only replace the SSRC, so the client would drop the packets of the new run as old or reset its jitter buffer.
+// A new SSRC continues the sequence numbers after the last packet and the timestamps by the wall clock time in between.
+type continuity struct {
+	clockRate uint32
+	started   bool
+	ssrc      uint32 // SSRC of the current run of the encoder
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16 // newest sequence number written
+	lastTs    uint32 // timestamp of the newest packet written
+	lastTime  time.Time
+	mutex     sync.Mutex
+}
+
+// rewrite shifts the sequence number and timestamp of the packet into the stream of the tracks
+func (c *continuity) rewrite(packet *rtp.Packet, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.started {
+		c.started = true
+		c.ssrc = packet.SSRC
+		c.lastSeq = packet.SequenceNumber - 1
+		c.lastTs = packet.Timestamp
+		c.lastTime = now
+	}
+
+	if packet.SSRC != c.ssrc {
+		c.ssrc = packet.SSRC
+		elapsed := uint32(now.Sub(c.lastTime).Seconds() * float64(c.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		c.seqOffset = c.lastSeq + 1 - packet.SequenceNumber
+		c.tsOffset = c.lastTs + elapsed - packet.Timestamp
+	}
+
+	packet.SequenceNumber += c.seqOffset
+	packet.Timestamp += c.tsOffset
+
+	// Reordered packets must not move the stream back
+	if int16(packet.SequenceNumber-c.lastSeq) > 0 {
+		c.lastSeq = packet.SequenceNumber
+		c.lastTs = packet.Timestamp
+		c.lastTime = now
+	}
+}
@@ -0,0 +1,50 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// TestContinuity checks that a restarted encoder continues the sequence numbers and timestamps of the previous run
+func TestContinuity(t *testing.T) {
+	type input struct {
+		ssrc      uint32
+		seq       uint16
+		timestamp uint32
+		at        time.Duration // since the first packet
+	}
+
+	start := time.Now()
+	c := &continuity{clockRate: 90000}
+
+	for i, test := range []struct {
+		input
+		seq       uint16
+		timestamp uint32
+	}{
+		// The first run is passed unchanged
+		{input{1, 65534, 1000, 0}, 65534, 1000},
+		{input{1, 65535, 4000, 33 * time.Millisecond}, 65535, 4000},
+		{input{1, 0, 7000, 66 * time.Millisecond}, 0, 7000},
+		// A new run continues after the last packet, its timestamps by the 100 ms in between
+		{input{2, 5000, 123, 166 * time.Millisecond}, 1, 16000},
+		{input{2, 5001, 3123, 200 * time.Millisecond}, 2, 19000},
+		// A reordered packet keeps its place
+		{input{2, 5003, 9123, 266 * time.Millisecond}, 4, 25000},
+		{input{2, 5002, 6123, 270 * time.Millisecond}, 3, 22000},
+		// The next run continues after the newest packet, not after the reordered one
+		{input{3, 0, 0, 366 * time.Millisecond}, 5, 34000},
+		// A packet of the same time as the last one still advances the timestamp
+		{input{4, 42, 42, 366 * time.Millisecond}, 6, 34001},
+	} {
+		packet := &rtp.Packet{Header: rtp.Header{SSRC: test.ssrc, SequenceNumber: test.input.seq, Timestamp: test.input.timestamp}}
+		c.rewrite(packet, start.Add(test.at))
+
+		if packet.SequenceNumber != test.seq || packet.Timestamp != test.timestamp {
+			t.Errorf("packet %d: rewritten to sequence number %d and timestamp %d, expected %d and %d",
+				i, packet.SequenceNumber, packet.Timestamp, test.seq, test.timestamp)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package hub fans out the media of one encoder to the tracks of all sessions receiving it.
+// Every session gets its own track, the hub writes each packet or sample to all active tracks.
+// The owner starts the encoder when the first track is added and stops it after the last one is removed.
+// Taps get a copy of the stream without keeping the encoder running, e.g. to record it.
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Hub distributes the output of one encoder to the tracks of the sessions
+type Hub struct {
+	codec     webrtc.RTPCodecCapability
+	id        string
+	streamID  string
+	samples   bool // the encoder delivers samples instead of RTP packets
+	tracks    map[webrtc.TrackLocal]struct{}
+	taps      map[Tap]struct{}
+	keyframes *keyframeLimiter // nil if the encoder cannot be asked for keyframes
+	sequence  *continuity      // see continuity.go
+	mutex     sync.Mutex
+}
+
+// Tap receives a copy of the stream of the encoder
+type Tap interface {
+	WriteRTP(packet *rtp.Packet) error
+	WriteSample(sample media.Sample) error
+}
+
+// New creates a hub for an encoder of the codec. With samples, the tracks packetize samples themselves.
+// onKeyframe forces a keyframe when a session needs one, e.g. a new viewer or a PLI of the client, it may be nil.
+// Example: h := hub.New(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "camera", false, func() { ... })
+func New(codec webrtc.RTPCodecCapability, id, streamID string, samples bool, onKeyframe func()) *Hub {
+	h := &Hub{
+		codec:    codec,
+		id:       id,
+		streamID: streamID,
+		samples:  samples,
+		tracks:   make(map[webrtc.TrackLocal]struct{}),
+		taps:     make(map[Tap]struct{}),
+		sequence: &continuity{clockRate: codec.ClockRate},
+	}
+	if onKeyframe != nil {
+		h.keyframes = &keyframeLimiter{interval: keyframeInterval, force: onKeyframe}
+	}
+	return h
+}
+
+// NewTrack creates a track for one session, it receives media once it is added
+func (h *Hub) NewTrack() (webrtc.TrackLocal, error) {
+	if h.samples {
+		track, err := webrtc.NewTrackLocalStaticSample(h.codec, h.id, h.streamID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s track: %w", h.id, err)
+		}
+		return track, nil
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(h.codec, h.id, h.streamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s track: %w", h.id, err)
+	}
+	return track, nil
+}
+
+// Codec returns the codec of the encoder
+func (h *Hub) Codec() webrtc.RTPCodecCapability {
+	return h.codec
+}
+
+// Add starts writing to the track and returns true if it is the first track
+func (h *Hub) Add(track webrtc.TrackLocal) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.tracks[track]; ok {
+		return false
+	}
+	h.tracks[track] = struct{}{}
+	return len(h.tracks) == 1
+}
+
+// Remove stops writing to the track and returns true if it was the last track
+func (h *Hub) Remove(track webrtc.TrackLocal) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.tracks[track]; !ok {
+		return false
+	}
+	delete(h.tracks, track)
+	return len(h.tracks) == 0
+}
+
+// Len returns the number of active tracks
+func (h *Hub) Len() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.tracks)
+}
+
+// AddTap starts passing the stream to the tap
+func (h *Hub) AddTap(tap Tap) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.taps[tap] = struct{}{}
+}
+
+// RemoveTap stops passing the stream to the tap
+func (h *Hub) RemoveTap(tap Tap) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.taps, tap)
+}
+
+// snapshot returns the active tracks and taps, so writing does not hold the lock
+func (h *Hub) snapshot() ([]webrtc.TrackLocal, []Tap) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	tracks := make([]webrtc.TrackLocal, 0, len(h.tracks))
+	for track := range h.tracks {
+		tracks = append(tracks, track)
+	}
+	taps := make([]Tap, 0, len(h.taps))
+	for tap := range h.taps {
+		taps = append(taps, tap)
+	}
+	return tracks, taps
+}
+
+// Write writes a raw RTP packet of the encoder to all active tracks and taps.
+// Write errors of single tracks and taps are ignored, their sessions are closing or their owner handles them.
+func (h *Hub) Write(data []byte) error {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(data); err != nil {
+		return fmt.Errorf("invalid RTP packet: %w", err)
+	}
+	h.sequence.rewrite(packet, time.Now())
+
+	tracks, taps := h.snapshot()
+	for _, track := range tracks {
+		if rtpTrack, ok := track.(*webrtc.TrackLocalStaticRTP); ok {
+			// Each track sets the SSRC and payload type of its bindings in the header
+			rtpTrack.WriteRTP(packet)
+		}
+	}
+	for _, tap := range taps {
+		tap.WriteRTP(packet)
+	}
+	return nil
+}
+
+// WriteSample writes a sample of the encoder to all active tracks and taps
+func (h *Hub) WriteSample(sample media.Sample) {
+	tracks, taps := h.snapshot()
+	for _, track := range tracks {
+		if sampleTrack, ok := track.(*webrtc.TrackLocalStaticSample); ok {
+			sampleTrack.WriteSample(sample)
+		}
+	}
+	for _, tap := range taps {
+		tap.WriteSample(sample)
+	}
+}
+
+// RequestKeyframe asks the encoder for a keyframe, rate limited to one per keyframe interval, see keyframe.go
+func (h *Hub) RequestKeyframe() {
+	if h.keyframes != nil {
+		h.keyframes.request()
+	}
+}
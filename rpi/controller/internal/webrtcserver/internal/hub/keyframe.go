@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// keyframeInterval is the minimum time between two keyframe requests passed to the encoder,
+// an encoder that has to restart for a keyframe limits its restarts further
+const keyframeInterval = 2 * time.Second
+
+// keyframeLimiter passes keyframe requests to the encoder at most once per interval.
+// A request within the interval is delayed to its end instead of dropped, so a viewer losing a picture
+// right after a forced keyframe still gets one. Further requests until then are merged into the delayed one.
+type keyframeLimiter struct {
+	interval time.Duration
+	force    func()
+	last     time.Time
+	pending  bool
+	mutex    sync.Mutex
+}
+
+// request forces a keyframe now or at the end of the interval
+func (l *keyframeLimiter) request() {
+	l.mutex.Lock()
+	if l.pending {
+		l.mutex.Unlock()
+		return
+	}
+
+	wait := l.interval - time.Since(l.last)
+	if wait > 0 {
+		l.pending = true
+		l.mutex.Unlock()
+		time.AfterFunc(wait, l.fire)
+		return
+	}
+
+	l.last = time.Now()
+	l.mutex.Unlock()
+	l.force()
+}
+
+// fire forces the delayed keyframe
+func (l *keyframeLimiter) fire() {
+	l.mutex.Lock()
+	l.pending = false
+	l.last = time.Now()
+	l.mutex.Unlock()
+	l.force()
+}
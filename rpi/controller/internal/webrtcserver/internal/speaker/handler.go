@@ -0,0 +1,258 @@
+// Package speaker plays the microphone of the operator on the output device of the speaker profile (SPEAKER_PROFILE).
+// The Opus RTP of the session that holds push-to-talk is sent to a local UDP port, from which an ffmpeg child decodes it
+// to the output device, mirroring how the capture pipelines work. While nobody talks, Opus silence frames keep the stream
+// continuous, so ffmpeg neither stalls nor has to be restarted for every talk spurt.
+package speaker
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/profiles"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/supervisor"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	payloadType   = 111
+	frameDuration = 20 * time.Millisecond
+	frameSamples  = 960               // samples of a 20 ms Opus frame at 48 kHz
+	silenceAfter  = 3 * frameDuration // silence is inserted when the talker sent nothing for this long
+)
+
+// silenceFrame is an Opus frame of 20 ms silence
+var silenceFrame = []byte{0xf8, 0xff, 0xfe}
+
+var packetsMetric = metrics.NewCounter("controller_speaker_packets_total", "RTP packets of the operator microphone played on the speaker.")
+
+// Handler forwards the microphone of the talking session to ffmpeg
+type Handler struct {
+	profile    profiles.Profile
+	supervisor *supervisor.Supervisor // runs ffmpeg
+	conn       *net.UDPConn           // sends RTP to ffmpeg while running
+	addr       *net.UDPAddr           // address ffmpeg receives the RTP on while running
+	refs       int                    // number of sessions sending a microphone track
+	stopChan   chan struct{}
+
+	// Output stream, restamped so it stays continuous across talkers and silence
+	ssrc       uint32
+	sequence   uint16
+	timestamp  uint32
+	source     uint32    // SSRC of the talker
+	offset     uint32    // added to the timestamps of the talker
+	lastPacket time.Time // last packet of the talker
+	mutex      sync.Mutex
+}
+
+// NewHandler creates a new speaker handler for the speaker profile selected by SPEAKER_PROFILE
+func NewHandler() *Handler {
+	profile, err := profiles.Selected(profiles.KindSpeaker)
+	if err != nil {
+		log.Fatalf("failed to load speaker profile: %v", err)
+	}
+	log.Printf("Using speaker profile %s", profile)
+
+	sh := &Handler{
+		profile: profile,
+		ssrc:    uint32(time.Now().UnixNano()),
+	}
+	sh.supervisor = supervisor.New("speaker", sh.ffmpegCommand, nil)
+	return sh
+}
+
+// Acquire starts ffmpeg for the first session sending a microphone track
+func (sh *Handler) Acquire() error {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.refs++
+	if sh.refs > 1 {
+		return nil
+	}
+
+	addr, err := sh.ingestAddr()
+	if err != nil {
+		sh.refs--
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		sh.refs--
+		return fmt.Errorf("failed to open UDP port %d: %w", addr.Port, err)
+	}
+	sh.conn = conn
+	sh.addr = addr
+	sh.stopChan = make(chan struct{})
+	sh.supervisor.Start()
+	go sh.fillSilence(sh.stopChan)
+
+	log.Printf("Started speaker pipeline on %s", addr)
+	return nil
+}
+
+// ingestAddr returns the address of the profile ffmpeg receives the RTP on, port 0 is replaced by a port that is free now.
+// ffmpeg binds the port itself, so it can only be taken by another process in between.
+func (sh *Handler) ingestAddr() (*net.UDPAddr, error) {
+	addr, err := sh.profile.IngestAddr()
+	if err != nil {
+		return nil, err
+	}
+	if addr.Port != 0 {
+		return addr, nil
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free UDP port: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// Release stops ffmpeg after the last session sending a microphone track
+func (sh *Handler) Release() {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if sh.refs == 0 {
+		return
+	}
+	sh.refs--
+	if sh.refs > 0 {
+		return
+	}
+
+	close(sh.stopChan)
+	sh.supervisor.Stop()
+	sh.conn.Close()
+	sh.conn = nil
+	log.Printf("Stopped speaker pipeline")
+}
+
+// WriteRTP plays an Opus packet of the talking session
+func (sh *Handler) WriteRTP(packet *rtp.Packet) error {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	// A new talk spurt or talker continues the timestamps after the last frame sent
+	if time.Since(sh.lastPacket) >= silenceAfter || packet.SSRC != sh.source {
+		sh.offset = sh.timestamp + frameSamples - packet.Timestamp
+		sh.source = packet.SSRC
+	}
+	sh.lastPacket = time.Now()
+
+	packetsMetric.Inc()
+	return sh.send(packet.Payload, packet.Timestamp+sh.offset)
+}
+
+// fillSilence sends silence frames while nobody talks until stopChan is closed
+func (sh *Handler) fillSilence(stopChan chan struct{}) {
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			sh.mutex.Lock()
+			if time.Since(sh.lastPacket) >= silenceAfter {
+				sh.send(silenceFrame, sh.timestamp+frameSamples)
+			}
+			sh.mutex.Unlock()
+		}
+	}
+}
+
+// send writes a restamped packet to ffmpeg, the caller holds the mutex
+func (sh *Handler) send(payload []byte, timestamp uint32) error {
+	if sh.conn == nil {
+		return nil
+	}
+
+	sh.sequence++
+	sh.timestamp = timestamp
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    payloadType,
+			SequenceNumber: sh.sequence,
+			Timestamp:      timestamp,
+			SSRC:           sh.ssrc,
+		},
+		Payload: payload,
+	}
+
+	data, err := packet.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal RTP packet: %w", err)
+	}
+	if _, err := sh.conn.Write(data); err != nil {
+		// ffmpeg is not listening yet or restarting
+		return nil
+	}
+	sh.supervisor.Touch()
+	return nil
+}
+
+// sessionDescription describes the RTP stream sent to the address for ffmpeg
+func sessionDescription(addr *net.UDPAddr) string {
+	return strings.Join([]string{
+		"v=0",
+		fmt.Sprintf("o=- 0 0 IN IP4 %s", addr.IP),
+		"s=speaker",
+		fmt.Sprintf("c=IN IP4 %s", addr.IP),
+		"t=0 0",
+		fmt.Sprintf("m=audio %d RTP/AVP %d", addr.Port, payloadType),
+		fmt.Sprintf("a=rtpmap:%d opus/48000/2", payloadType),
+		"",
+	}, "\r\n")
+}
+
+// ffmpegCommand creates the ffmpeg process of the profile, which receives the RTP on the UDP port and plays it on the output device
+func (sh *Handler) ffmpegCommand() *exec.Cmd {
+	ffmpegBinary := os.Getenv("FFMPEG_BINARY")
+	if ffmpegBinary == "" {
+		ffmpegBinary = "ffmpeg"
+	}
+
+	ffmpegLogLevel := os.Getenv("FFMPEG_LOG_LEVEL")
+	if ffmpegLogLevel == "" {
+		ffmpegLogLevel = "error"
+	}
+
+	profile := sh.profile
+
+	sh.mutex.Lock()
+	addr := sh.addr
+	sh.mutex.Unlock()
+
+	// Setup FFmpeg to receive the RTP described by the session description on stdin and play it
+	args := []string{
+		"-loglevel", ffmpegLogLevel,
+		"-hide_banner", // removes version/config dump
+		"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
+		"-protocol_whitelist", "pipe,udp,rtp",
+		"-f", "sdp", // input mode
+		"-i", "pipe:0", // session description
+	}
+	args = append(args, profile.ExtraArgs...)
+	if profile.Format != "" {
+		args = append(args, "-f", profile.Format) // output mode
+	}
+	args = append(args, profile.Output) // output device
+
+	ffmpeg := exec.Command(ffmpegBinary, args...)
+	ffmpeg.Stdin = strings.NewReader(sessionDescription(addr))
+	ffmpeg.Stdout = io.Discard // all logs in ffmpeg go to stderr, which is read by the supervisor
+	return ffmpeg
+}
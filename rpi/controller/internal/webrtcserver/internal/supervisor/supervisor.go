@@ -0,0 +1,290 @@
+// Package supervisor runs a media process (ffmpeg or a hardware encoder) and restarts it when it exits or stalls.
+// Restarts are delayed by an exponential backoff, after too many failures in a row the supervisor gives up.
+// The lines of stderr are logged and matched against known failure reasons, which are reported with the state.
+package supervisor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States reported to the state callback
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateBackoff  = "backoff"
+	StateFailed   = "failed"
+	StateStopped  = "stopped"
+)
+
+const (
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+	maxFailures  = 6                // failures in a row before the supervisor gives up
+	stableAfter  = 30 * time.Second // a process running this long resets the failure count
+	startupGrace = 2 * time.Second  // a process running this long is reported as running
+	stallTimeout = 10 * time.Second // a running process without output for this long is restarted
+)
+
+// failureReasons maps stderr messages of ffmpeg and libcamera to the reason reported to the client
+var failureReasons = []struct {
+	pattern string
+	reason  string
+}{
+	{"No such file or directory", "input device not found"},
+	{"Could not find video device", "input device not found"},
+	{"Could not find audio only device", "input device not found"},
+	{"Device or resource busy", "input device busy"},
+	{"Input/output error", "input device disconnected"},
+	{"No such device", "input device disconnected"},
+	{"Permission denied", "permission denied"},
+	{"Unknown encoder", "encoder not available"},
+	{"Encoder not found", "encoder not available"},
+	{"Address already in use", "UDP port in use"},
+	{"Invalid argument", "invalid argument"},
+	{"no cameras available", "no camera available"},
+}
+
+// Status describes the state of the supervised process
+type Status struct {
+	State   string
+	Reason  string        // failure reason of the last exit, empty if unknown
+	Attempt int           // number of the current start since Start, beginning with 1
+	RetryIn time.Duration // delay before the next start in state backoff
+}
+
+// Supervisor runs a process between Start and Stop and restarts it on failure
+type Supervisor struct {
+	name        string
+	command     func() *exec.Cmd // creates the process for every start
+	onState     func(Status)
+	stopChan    chan struct{}
+	done        chan struct{} // closed when the run of the last Start returned
+	restartChan chan struct{}
+	lastOutput  time.Time
+	running     bool
+	mu          sync.Mutex
+}
+
+// New creates a supervisor, which creates the process with command for every start and reports state changes to onState.
+// Example: s := supervisor.New("video vp8", func() *exec.Cmd { return exec.Command("ffmpeg", ...) }, func(status supervisor.Status) { ... })
+func New(name string, command func() *exec.Cmd, onState func(Status)) *Supervisor {
+	return &Supervisor{
+		name:        name,
+		command:     command,
+		onState:     onState,
+		restartChan: make(chan struct{}, 1),
+	}
+}
+
+// Start starts the process and keeps it running until Stop is called
+func (s *Supervisor) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+	stopChan := make(chan struct{})
+	s.stopChan = stopChan
+	previous := s.done
+	done := make(chan struct{})
+	s.done = done
+
+	go func() {
+		defer close(done)
+
+		// The run of the previous Start kills its process first, so two processes never run at once, e.g. on the same UDP port
+		if previous != nil {
+			<-previous
+		}
+
+		// A restart requested while not running is already picked up by the first start
+		select {
+		case <-s.restartChan:
+		default:
+		}
+
+		s.run(stopChan)
+	}()
+}
+
+// Stop stops the process. It does not wait for the process to exit, the next Start does.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return
+	}
+	s.running = false
+	close(s.stopChan)
+}
+
+// Restart restarts the process immediately without backoff, e.g. to apply new encoder settings
+func (s *Supervisor) Restart() {
+	select {
+	case s.restartChan <- struct{}{}:
+	default:
+	}
+}
+
+// Touch records output of the process, a running process without output is restarted after the stall timeout
+func (s *Supervisor) Touch() {
+	s.mu.Lock()
+	s.lastOutput = time.Now()
+	s.mu.Unlock()
+}
+
+// run starts the process until stopChan is closed
+func (s *Supervisor) run(stopChan chan struct{}) {
+	failures := 0
+
+	for attempt := 1; ; attempt++ {
+		// A restart may have been picked instead of a stop at the same time
+		select {
+		case <-stopChan:
+			s.report(Status{State: StateStopped, Attempt: attempt})
+			return
+		default:
+		}
+
+		s.report(Status{State: StateStarting, Attempt: attempt})
+
+		started := time.Now()
+		reason, restart, stopped := s.runOnce(stopChan, attempt)
+		if stopped {
+			s.report(Status{State: StateStopped, Attempt: attempt})
+			return
+		}
+		if restart {
+			continue
+		}
+
+		if time.Since(started) >= stableAfter {
+			failures = 0
+		}
+		failures++
+
+		if failures >= maxFailures {
+			log.Printf("%s failed %d times in a row, giving up: %s", s.name, failures, reason)
+			s.report(Status{State: StateFailed, Reason: reason, Attempt: attempt})
+
+			// Stay failed until the next Start
+			<-stopChan
+			return
+		}
+
+		backoff := min(minBackoff<<(failures-1), maxBackoff)
+		log.Printf("%s exited (%s), restarting in %v", s.name, reason, backoff)
+		s.report(Status{State: StateBackoff, Reason: reason, Attempt: attempt, RetryIn: backoff})
+
+		select {
+		case <-stopChan:
+			s.report(Status{State: StateStopped, Attempt: attempt})
+			return
+		case <-s.restartChan:
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// runOnce runs the process until it exits, stalls, is restarted or stopped.
+// It returns the failure reason and whether the process was restarted or stopped on purpose.
+func (s *Supervisor) runOnce(stopChan chan struct{}, attempt int) (reason string, restart bool, stopped bool) {
+	cmd := s.command()
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Sprintf("failed to get stderr: %v", err), false, false
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Sprintf("start error: %v", err), false, false
+	}
+
+	// Log stderr and remember the last known failure reason
+	reasonChan := make(chan string, 1)
+	go func() {
+		reasonChan <- s.scanStderr(stderr)
+	}()
+
+	exitChan := make(chan error, 1)
+	go func() {
+		reason := <-reasonChan // stderr has to be read completely before Wait
+		err := cmd.Wait()
+		if reason != "" {
+			err = fmt.Errorf("%s", reason)
+		}
+		exitChan <- err
+	}()
+
+	s.Touch()
+	grace := time.NewTimer(startupGrace)
+	defer grace.Stop()
+	stallTicker := time.NewTicker(stallTimeout / 5)
+	defer stallTicker.Stop()
+
+	kill := func() {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Printf("Error killing %s process: %v", s.name, err)
+		}
+		<-exitChan
+	}
+
+	for {
+		select {
+		case <-stopChan:
+			kill()
+			return "", false, true
+		case <-s.restartChan:
+			kill()
+			return "", true, false
+		case <-grace.C:
+			s.report(Status{State: StateRunning, Attempt: attempt})
+		case <-stallTicker.C:
+			s.mu.Lock()
+			stalled := time.Since(s.lastOutput) >= stallTimeout
+			s.mu.Unlock()
+			if stalled {
+				kill()
+				return "no output", false, false
+			}
+		case err := <-exitChan:
+			if err == nil {
+				return "exited", false, false
+			}
+			return err.Error(), false, false
+		}
+	}
+}
+
+// scanStderr logs the lines of stderr and returns the last known failure reason
+func (s *Supervisor) scanStderr(stderr io.Reader) string {
+	reason := ""
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Printf("%s: %s", s.name, line)
+
+		for _, known := range failureReasons {
+			if strings.Contains(line, known.pattern) {
+				reason = known.reason
+			}
+		}
+	}
+	return reason
+}
+
+func (s *Supervisor) report(status Status) {
+	if s.onState != nil {
+		s.onState(status)
+	}
+}
@@ -0,0 +1,63 @@
+package supervisor
+
+import (
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStartAfterStop stops and starts the supervisor back to back, the process of a run has to exit before the next one starts
+func TestStartAfterStop(t *testing.T) {
+	var mutex sync.Mutex
+	var states []string
+	s := New("test", func() *exec.Cmd {
+		return exec.Command("sleep", "10")
+	}, func(status Status) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, status.State)
+	})
+
+	for i := 0; i < 10; i++ {
+		s.Start()
+		time.Sleep(10 * time.Millisecond)
+		s.Restart()
+		s.Stop()
+	}
+	s.Start()
+	time.Sleep(100 * time.Millisecond)
+	s.Stop()
+	s.Start()
+	s.Stop()
+
+	// Wait for the last run
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("last run did not return")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	running := 0
+	for i, state := range states {
+		switch state {
+		case StateStarting:
+			running++
+		case StateStopped:
+			// A run stopped before its first start reports stopped only
+			running = max(running-1, 0)
+		}
+		if running > 1 {
+			t.Fatalf("state %d: two processes are starting at once: %v", i, states)
+		}
+	}
+	if running > 0 {
+		t.Fatalf("%d runs did not stop: %v", running, states)
+	}
+}
@@ -0,0 +1,802 @@
+//go:build ignore
+
+// gen writes the sample files of the synthetic sources without ffmpeg or libvpx:
+//   video.ivf: 2 s of a 640x480 VP8 test pattern at 30 fps, 8 color bars and a white square moving from left to right.
+//     Every frame is a keyframe of flat 16x16 macroblocks, each coded with DC prediction and a single DC coefficient
+//     (RFC 6386), which is all a test pattern needs.
+//   audio.ogg: 2 s of Opus silence in 20 ms frames. Encoding a tone would need a real Opus encoder.
+// Run it with go generate in this directory. Any VP8 IVF or Ogg Opus file can replace the samples, e.g.
+//   ffmpeg -f lavfi -i testsrc=size=640x480:rate=30 -t 2 -c:v libvpx -g 30 video.ivf
+//   ffmpeg -f lavfi -i sine=frequency=440:sample_rate=48000 -t 2 -c:a libopus -frame_duration 20 audio.ogg
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+const (
+	width     = 640
+	height    = 480
+	framerate = 30
+	frames    = 2 * framerate
+
+	opusFrameSamples = 960 // 20 ms at 48 kHz
+	opusFrames       = 100
+)
+
+// color is a flat YCbCr color of a macroblock
+type color struct{ y, u, v int }
+
+// Colors of the bars in BT.601 limited range
+var (
+	white   = color{235, 128, 128}
+	yellow  = color{210, 16, 146}
+	cyan    = color{170, 166, 16}
+	green   = color{145, 54, 34}
+	magenta = color{106, 202, 222}
+	red     = color{81, 90, 240}
+	blue    = color{41, 240, 110}
+	black   = color{16, 128, 128}
+	gray    = color{40, 128, 128}
+	bars    = []color{white, yellow, cyan, green, magenta, red, blue, black}
+)
+
+// silenceFrame is an Opus frame of 20 ms silence
+var silenceFrame = []byte{0xf8, 0xff, 0xfe}
+
+func main() {
+	if err := writeVideo("video.ivf"); err != nil {
+		log.Fatalf("failed to write video sample: %v", err)
+	}
+	if err := writeAudio("audio.ogg"); err != nil {
+		log.Fatalf("failed to write audio sample: %v", err)
+	}
+}
+
+// pattern returns the color of each macroblock of the frame
+func pattern(frame int) [][]color {
+	mbw, mbh := width/16, height/16
+	square := frame * (mbw - 1) / frames
+
+	mbs := make([][]color, mbh)
+	for y := range mbs {
+		mbs[y] = make([]color, mbw)
+		for x := range mbs[y] {
+			switch {
+			case y < mbh*3/4:
+				mbs[y][x] = bars[x*len(bars)/mbw]
+			case y >= mbh*3/4+2 && y < mbh*3/4+4 && x >= square && x < square+2:
+				mbs[y][x] = white
+			default:
+				mbs[y][x] = gray
+			}
+		}
+	}
+	return mbs
+}
+
+// writeVideo writes the frames into an IVF file with the time base of the frame rate
+func writeVideo(path string) error {
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32) // header size
+	copy(header[8:], "VP80")
+	binary.LittleEndian.PutUint16(header[12:], width)
+	binary.LittleEndian.PutUint16(header[14:], height)
+	binary.LittleEndian.PutUint32(header[16:], framerate) // time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)         // time base numerator
+	binary.LittleEndian.PutUint32(header[24:], frames)
+
+	data := header
+	for i := 0; i < frames; i++ {
+		frame := encodeKeyframe(pattern(i))
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], uint64(i))
+		data = append(data, frameHeader...)
+		data = append(data, frame...)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// writeAudio writes the silence frames into an Ogg Opus file
+func writeAudio(path string) error {
+	writer, err := oggwriter.New(path, 48000, 1)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < opusFrames; i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * opusFrameSamples)},
+			Payload: silenceFrame,
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// Token probability planes of RFC 6386 section 13.3
+const (
+	planeYAfterY2 = 0
+	planeY2       = 1
+	planeUV       = 2
+)
+
+// Probabilities of the extra bits of the DCT token categories 3 to 6, section 13.2
+var categoryProbs = [4][]uint8{
+	{173, 148, 140},
+	{176, 155, 140, 135},
+	{180, 157, 141, 134, 130},
+	{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+}
+
+// Intra prediction modes of a macroblock, section 12.2
+const (
+	predDC = iota
+	predV  // copies the row above
+	predH  // copies the column to the left
+)
+
+// macroblock is the prediction of a flat macroblock and the difference to its color
+type macroblock struct {
+	lumaMode   int
+	chromaMode int
+	residual   color
+}
+
+// encodeKeyframe encodes a keyframe of flat macroblocks. A macroblock with the color of the macroblock above or to the left
+// copies it with V_PRED or H_PRED and is skipped, any other is predicted with DC_PRED and the difference to its color is coded
+// as DC of the Y2 block and of the chroma blocks. The quantizer index is 0, so a Y2 level of 8*d and a chroma level of 2*d
+// add exactly d to every pixel. The loop filter is off.
+func encodeKeyframe(mbs [][]color) []byte {
+	mbh, mbw := len(mbs), len(mbs[0])
+
+	header := newBoolEncoder()
+	header.literal(1, 0) // color space
+	header.literal(1, 0) // clamping type
+	header.literal(1, 0) // no segmentation
+	header.literal(1, 0) // normal loop filter
+	header.literal(6, 0) // loop filter level 0
+	header.literal(3, 0) // sharpness
+	header.literal(1, 0) // no loop filter deltas
+	header.literal(2, 0) // one token partition
+	header.literal(7, 0) // quantizer index
+	for i := 0; i < 5; i++ {
+		header.literal(1, 0) // no quantizer deltas
+	}
+	header.literal(1, 0) // do not keep the probabilities
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, prob := range tokenProbUpdateProb[i][j][k] {
+					header.put(prob, false) // default token probabilities
+				}
+			}
+		}
+	}
+
+	coded := 0
+	for mby := range mbs {
+		for mbx := range mbs[mby] {
+			if predict(mbs, mbx, mby).residual != (color{}) {
+				coded++
+			}
+		}
+	}
+	skipProb := uint8(max(1, min(255, 256*coded/(mbw*mbh))))
+	header.literal(1, 1) // macroblocks without residual are skipped
+	header.literal(8, uint32(skipProb))
+
+	tokens := newBoolEncoder()
+	// Non-zero flags of the blocks to the left and above, which select the token probabilities
+	upY2 := make([]int, mbw)
+	upU := make([][2]int, mbw)
+	upV := make([][2]int, mbw)
+
+	for mby := 0; mby < mbh; mby++ {
+		leftY2 := 0
+		var leftU, leftV [2]int
+
+		for mbx := 0; mbx < mbw; mbx++ {
+			mb := predict(mbs, mbx, mby)
+			skip := mb.residual == (color{})
+
+			header.put(skipProb, skip)
+			header.put(145, true) // 16x16 prediction
+			switch mb.lumaMode {
+			case predDC:
+				header.put(156, false)
+				header.put(163, false)
+			case predV:
+				header.put(156, false)
+				header.put(163, true)
+			case predH:
+				header.put(156, true)
+				header.put(128, false)
+			}
+			switch mb.chromaMode {
+			case predDC:
+				header.put(142, false)
+			case predV:
+				header.put(142, true)
+				header.put(114, false)
+			case predH:
+				header.put(142, true)
+				header.put(114, true)
+				header.put(183, false)
+			}
+
+			if skip {
+				// The blocks of a skipped macroblock count as zero for the token probabilities
+				leftY2, upY2[mbx] = 0, 0
+				leftU, upU[mbx], leftV, upV[mbx] = [2]int{}, [2]int{}, [2]int{}, [2]int{}
+				continue
+			}
+
+			nz := tokens.dc(planeY2, leftY2+upY2[mbx], 8*mb.residual.y)
+			leftY2, upY2[mbx] = nz, nz
+
+			// The 16 luma blocks only carry the DC of the Y2 block, they start at the first AC coefficient
+			for i := 0; i < 16; i++ {
+				tokens.put(defaultTokenProb[planeYAfterY2][1][0][0], false)
+			}
+
+			tokens.chroma(&leftU, &upU[mbx], 2*mb.residual.u)
+			tokens.chroma(&leftV, &upV[mbx], 2*mb.residual.v)
+		}
+	}
+
+	first := header.flush()
+	frame := make([]byte, 10, 10+len(first)+len(tokens.out))
+	tag := uint32(0) | 0<<1 | 1<<4 | uint32(len(first))<<5 // keyframe, version 0, shown, size of the first partition
+	frame[0], frame[1], frame[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(frame[6:], width)
+	binary.LittleEndian.PutUint16(frame[8:], height)
+	frame = append(frame, first...)
+	return append(frame, tokens.flush()...)
+}
+
+// predict chooses the prediction modes of a macroblock, the macroblocks to the left and above are decoded exactly
+func predict(mbs [][]color, mbx, mby int) macroblock {
+	target := mbs[mby][mbx]
+	mb := macroblock{lumaMode: predDC, chromaMode: predDC}
+
+	// DC_PRED averages the edges which are inside the frame
+	dc := color{128, 128, 128}
+	switch {
+	case mbx > 0 && mby > 0:
+		left, above := mbs[mby][mbx-1], mbs[mby-1][mbx]
+		dc = color{(left.y + above.y + 1) >> 1, (left.u + above.u + 1) >> 1, (left.v + above.v + 1) >> 1}
+	case mbx > 0:
+		dc = mbs[mby][mbx-1]
+	case mby > 0:
+		dc = mbs[mby-1][mbx]
+	}
+	mb.residual = color{target.y - dc.y, target.u - dc.u, target.v - dc.v}
+
+	if mby > 0 && mbs[mby-1][mbx].y == target.y {
+		mb.lumaMode, mb.residual.y = predV, 0
+	} else if mbx > 0 && mbs[mby][mbx-1].y == target.y {
+		mb.lumaMode, mb.residual.y = predH, 0
+	}
+
+	if above := mbs[max(mby-1, 0)][mbx]; mby > 0 && above.u == target.u && above.v == target.v {
+		mb.chromaMode, mb.residual.u, mb.residual.v = predV, 0, 0
+	} else if left := mbs[mby][max(mbx-1, 0)]; mbx > 0 && left.u == target.u && left.v == target.v {
+		mb.chromaMode, mb.residual.u, mb.residual.v = predH, 0, 0
+	}
+	return mb
+}
+
+// chroma codes the same DC level in the four blocks of a chroma plane and updates the non-zero flags
+func (e *boolEncoder) chroma(left, up *[2]int, level int) {
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			nz := e.dc(planeUV, left[y]+up[x], level)
+			left[y], up[x] = nz, nz
+		}
+	}
+}
+
+// dc codes a block with only a DC coefficient and returns 1 if it is non-zero, section 13
+func (e *boolEncoder) dc(plane, ctx, level int) int {
+	probs := &defaultTokenProb[plane]
+	if level == 0 {
+		e.put(probs[0][ctx][0], false) // end of block
+		return 0
+	}
+
+	p := probs[0][ctx]
+	e.put(p[0], true)
+	v := level
+	if v < 0 {
+		v = -v
+	}
+	e.token(p, v)
+	e.put(128, level < 0) // sign
+
+	// End of block after the DC, the context is the magnitude of the DC token
+	next := 2
+	if v == 1 {
+		next = 1
+	}
+	e.put(probs[1][next][0], false)
+	return 1
+}
+
+// token codes the magnitude of a non-zero coefficient with the token tree of section 13.2
+func (e *boolEncoder) token(p [11]uint8, v int) {
+	e.put(p[1], true)
+	if v == 1 {
+		e.put(p[2], false)
+		return
+	}
+	e.put(p[2], true)
+	if v <= 4 {
+		e.put(p[3], false)
+		if v == 2 {
+			e.put(p[4], false)
+		} else {
+			e.put(p[4], true)
+			e.put(p[5], v == 4)
+		}
+		return
+	}
+	e.put(p[3], true)
+	if v <= 10 {
+		e.put(p[6], false)
+		if v <= 6 {
+			e.put(p[7], false)
+			e.put(159, v == 6)
+		} else {
+			e.put(p[7], true)
+			e.put(165, (v-7)&2 != 0)
+			e.put(145, (v-7)&1 != 0)
+		}
+		return
+	}
+	e.put(p[6], true)
+
+	category := 3
+	switch {
+	case v < 19:
+		category = 0
+	case v < 35:
+		category = 1
+	case v < 67:
+		category = 2
+	}
+	e.put(p[8], category >= 2)
+	e.put(p[9+category/2], category%2 == 1)
+
+	extra := v - (3 + 8<<category)
+	probs := categoryProbs[category]
+	for i, prob := range probs {
+		e.put(prob, extra>>(len(probs)-1-i)&1 != 0)
+	}
+}
+
+// boolEncoder is the boolean entropy encoder of RFC 6386 section 7.3
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// put codes a bit, which is false with the probability prob/256
+func (e *boolEncoder) put(prob uint8, bit bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// literal codes the n bits of v with even probability, most significant bit first
+func (e *boolEncoder) literal(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		e.put(128, v>>i&1 != 0)
+	}
+}
+
+// carry adds one to the bytes written so far
+func (e *boolEncoder) carry() {
+	for i := len(e.out) - 1; i >= 0; i-- {
+		e.out[i]++
+		if e.out[i] != 0 {
+			return
+		}
+	}
+}
+
+// flush writes the remaining bits and returns the coded partition
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
+
+// Token probability update probabilities, section 13.4
+var tokenProbUpdateProb = [4][8][3][11]uint8{
+	{
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{176, 246, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{223, 241, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 244, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{234, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 246, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{239, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 248, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 253, 255, 254, 255, 255, 255, 255, 255, 255},
+			{250, 255, 254, 255, 254, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{217, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{225, 252, 241, 253, 255, 255, 254, 255, 255, 255, 255},
+			{234, 250, 241, 250, 253, 255, 253, 254, 255, 255, 255},
+		},
+		{
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{223, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{238, 253, 254, 254, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 248, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{247, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{186, 251, 250, 255, 255, 255, 255, 255, 255, 255, 255},
+			{234, 251, 244, 254, 255, 255, 255, 255, 255, 255, 255},
+			{251, 251, 243, 253, 254, 255, 254, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{236, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 253, 253, 254, 254, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{248, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 254, 252, 254, 255, 255, 255, 255, 255, 255, 255},
+			{248, 254, 249, 253, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{246, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 254, 251, 254, 254, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{248, 254, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 254, 254, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 251, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{245, 251, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 251, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 252, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+}
+
+// Default token probabilities, section 13.5
+var defaultTokenProb = [4][8][3][11]uint8{
+	{
+		{
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{253, 136, 254, 255, 228, 219, 128, 128, 128, 128, 128},
+			{189, 129, 242, 255, 227, 213, 255, 219, 128, 128, 128},
+			{106, 126, 227, 252, 214, 209, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 98, 248, 255, 236, 226, 255, 255, 128, 128, 128},
+			{181, 133, 238, 254, 221, 234, 255, 154, 128, 128, 128},
+			{78, 134, 202, 247, 198, 180, 255, 219, 128, 128, 128},
+		},
+		{
+			{1, 185, 249, 255, 243, 255, 128, 128, 128, 128, 128},
+			{184, 150, 247, 255, 236, 224, 128, 128, 128, 128, 128},
+			{77, 110, 216, 255, 236, 230, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 101, 251, 255, 241, 255, 128, 128, 128, 128, 128},
+			{170, 139, 241, 252, 236, 209, 255, 255, 128, 128, 128},
+			{37, 116, 196, 243, 228, 255, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 204, 254, 255, 245, 255, 128, 128, 128, 128, 128},
+			{207, 160, 250, 255, 238, 128, 128, 128, 128, 128, 128},
+			{102, 103, 231, 255, 211, 171, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 152, 252, 255, 240, 255, 128, 128, 128, 128, 128},
+			{177, 135, 243, 255, 234, 225, 128, 128, 128, 128, 128},
+			{80, 129, 211, 255, 194, 224, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{246, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{255, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{198, 35, 237, 223, 193, 187, 162, 160, 145, 155, 62},
+			{131, 45, 198, 221, 172, 176, 220, 157, 252, 221, 1},
+			{68, 47, 146, 208, 149, 167, 221, 162, 255, 223, 128},
+		},
+		{
+			{1, 149, 241, 255, 221, 224, 255, 255, 128, 128, 128},
+			{184, 141, 234, 253, 222, 220, 255, 199, 128, 128, 128},
+			{81, 99, 181, 242, 176, 190, 249, 202, 255, 255, 128},
+		},
+		{
+			{1, 129, 232, 253, 214, 197, 242, 196, 255, 255, 128},
+			{99, 121, 210, 250, 201, 198, 255, 202, 128, 128, 128},
+			{23, 91, 163, 242, 170, 187, 247, 210, 255, 255, 128},
+		},
+		{
+			{1, 200, 246, 255, 234, 255, 128, 128, 128, 128, 128},
+			{109, 178, 241, 255, 231, 245, 255, 255, 128, 128, 128},
+			{44, 130, 201, 253, 205, 192, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 132, 239, 251, 219, 209, 255, 165, 128, 128, 128},
+			{94, 136, 225, 251, 218, 190, 255, 255, 128, 128, 128},
+			{22, 100, 174, 245, 186, 161, 255, 199, 128, 128, 128},
+		},
+		{
+			{1, 182, 249, 255, 232, 235, 128, 128, 128, 128, 128},
+			{124, 143, 241, 255, 227, 234, 128, 128, 128, 128, 128},
+			{35, 77, 181, 251, 193, 211, 255, 205, 128, 128, 128},
+		},
+		{
+			{1, 157, 247, 255, 236, 231, 255, 255, 128, 128, 128},
+			{121, 141, 235, 255, 225, 227, 255, 255, 128, 128, 128},
+			{45, 99, 188, 251, 195, 217, 255, 224, 128, 128, 128},
+		},
+		{
+			{1, 1, 251, 255, 213, 255, 128, 128, 128, 128, 128},
+			{203, 1, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+			{137, 1, 177, 255, 224, 255, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{253, 9, 248, 251, 207, 208, 255, 192, 128, 128, 128},
+			{175, 13, 224, 243, 193, 185, 249, 198, 255, 255, 128},
+			{73, 17, 171, 221, 161, 179, 236, 167, 255, 234, 128},
+		},
+		{
+			{1, 95, 247, 253, 212, 183, 255, 255, 128, 128, 128},
+			{239, 90, 244, 250, 211, 209, 255, 255, 128, 128, 128},
+			{155, 77, 195, 248, 188, 195, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 24, 239, 251, 218, 219, 255, 205, 128, 128, 128},
+			{201, 51, 219, 255, 196, 186, 128, 128, 128, 128, 128},
+			{69, 46, 190, 239, 201, 218, 255, 228, 128, 128, 128},
+		},
+		{
+			{1, 191, 251, 255, 255, 128, 128, 128, 128, 128, 128},
+			{223, 165, 249, 255, 213, 255, 128, 128, 128, 128, 128},
+			{141, 124, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 16, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+			{190, 36, 230, 255, 236, 255, 128, 128, 128, 128, 128},
+			{149, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 226, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{247, 192, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{240, 128, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 134, 252, 255, 255, 128, 128, 128, 128, 128, 128},
+			{213, 62, 250, 255, 255, 128, 128, 128, 128, 128, 128},
+			{55, 93, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{202, 24, 213, 235, 186, 191, 220, 160, 240, 175, 255},
+			{126, 38, 182, 232, 169, 184, 228, 174, 255, 187, 128},
+			{61, 46, 138, 219, 151, 178, 240, 170, 255, 216, 128},
+		},
+		{
+			{1, 112, 230, 250, 199, 191, 247, 159, 255, 255, 128},
+			{166, 109, 228, 252, 211, 215, 255, 174, 128, 128, 128},
+			{39, 77, 162, 232, 172, 180, 245, 178, 255, 255, 128},
+		},
+		{
+			{1, 52, 220, 246, 198, 199, 249, 220, 255, 255, 128},
+			{124, 74, 191, 243, 183, 193, 250, 221, 255, 255, 128},
+			{24, 71, 130, 219, 154, 170, 243, 182, 255, 255, 128},
+		},
+		{
+			{1, 182, 225, 249, 219, 240, 255, 224, 128, 128, 128},
+			{149, 150, 226, 252, 216, 205, 255, 171, 128, 128, 128},
+			{28, 108, 170, 242, 183, 194, 254, 223, 255, 255, 128},
+		},
+		{
+			{1, 81, 230, 252, 204, 203, 255, 192, 128, 128, 128},
+			{123, 102, 209, 247, 188, 196, 255, 233, 128, 128, 128},
+			{20, 95, 153, 243, 164, 173, 255, 203, 128, 128, 128},
+		},
+		{
+			{1, 222, 248, 255, 216, 213, 128, 128, 128, 128, 128},
+			{168, 175, 246, 252, 235, 205, 255, 255, 128, 128, 128},
+			{47, 116, 215, 255, 211, 212, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 121, 236, 253, 212, 214, 255, 255, 128, 128, 128},
+			{141, 84, 213, 252, 201, 202, 255, 219, 128, 128, 128},
+			{42, 80, 160, 240, 162, 185, 255, 205, 128, 128, 128},
+		},
+		{
+			{1, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{244, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{238, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+}
@@ -0,0 +1,194 @@
+// Package synthetic plays embedded media samples in a loop, so the controller streams video and audio without ffmpeg,
+// camera or microphone, e.g. in tests and CI. video.ivf is a VP8 test pattern, audio.ogg is Opus, both are written by gen.go.
+// The samples are written to the tracks with the duration of every frame, so the RTP timestamps advance like those of a
+// live encoder, also across the end of the loop.
+package synthetic
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+//go:embed video.ivf
+var videoSample []byte
+
+//go:embed audio.ogg
+var audioSample []byte
+
+// frame is one frame of a sample
+type frame struct {
+	data     []byte
+	duration time.Duration
+	keyframe bool
+}
+
+// Source loops the frames of a sample
+type Source struct {
+	name     string
+	codec    webrtc.RTPCodecCapability
+	frames   []frame
+	keyframe atomic.Bool // a keyframe was requested
+}
+
+// Video returns the source of the embedded VP8 test pattern
+func Video() (*Source, error) {
+	reader, header, err := ivfreader.NewWith(bytes.NewReader(videoSample))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video sample: %w", err)
+	}
+	if string(header.FourCC[:]) != "VP80" {
+		return nil, fmt.Errorf("unsupported video sample codec %q", header.FourCC[:])
+	}
+
+	const clockRate = 90000
+	s := &Source{
+		name:  "video",
+		codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: clockRate},
+	}
+
+	// A frame lasts until the next one, the last frame as long as one unit of the time base
+	var timestamps []uint64
+	for {
+		data, frameHeader, err := reader.ParseNextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read video sample: %w", err)
+		}
+		s.frames = append(s.frames, frame{data: data, keyframe: len(data) > 0 && data[0]&0x01 == 0})
+		// ivfreader divides the timestamp by the time base instead of multiplying, this restores the units of the file
+		timestamps = append(timestamps, frameHeader.Timestamp*uint64(header.TimebaseNumerator)/uint64(header.TimebaseDenominator))
+	}
+	if len(s.frames) == 0 {
+		return nil, errors.New("video sample has no frames")
+	}
+
+	for i := range s.frames {
+		units := uint64(1)
+		if i+1 < len(timestamps) && timestamps[i+1] > timestamps[i] {
+			units = timestamps[i+1] - timestamps[i]
+		}
+		ticks := units * clockRate * uint64(header.TimebaseNumerator) / uint64(header.TimebaseDenominator)
+		s.frames[i].duration = tickDuration(ticks, clockRate)
+	}
+	return s, nil
+}
+
+// Audio returns the source of the embedded Opus sample
+func Audio() (*Source, error) {
+	reader, _, err := oggreader.NewWith(bytes.NewReader(audioSample))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio sample: %w", err)
+	}
+
+	const clockRate = 48000
+	s := &Source{
+		name:  "audio",
+		codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: clockRate, Channels: 2},
+	}
+
+	// Every page holds one Opus packet, its duration is given by its table of contents byte
+	for {
+		data, _, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audio sample: %w", err)
+		}
+		if bytes.HasPrefix(data, []byte("OpusTags")) {
+			continue
+		}
+
+		samples, err := opusSamples(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audio sample: %w", err)
+		}
+		s.frames = append(s.frames, frame{data: data, duration: tickDuration(samples, clockRate), keyframe: true})
+	}
+	if len(s.frames) == 0 {
+		return nil, errors.New("audio sample has no frames")
+	}
+	return s, nil
+}
+
+// Codec returns the codec of the sample
+func (s *Source) Codec() webrtc.RTPCodecCapability {
+	return s.codec
+}
+
+// RequestKeyframe makes the loop restart at its first frame, unless the next frame is a keyframe anyway
+func (s *Source) RequestKeyframe() {
+	s.keyframe.Store(true)
+}
+
+// Play writes the frames in a loop at their pace until stopChan is closed
+func (s *Source) Play(write func(media.Sample), stopChan <-chan struct{}) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	next := time.Now()
+	for i := 0; ; i = (i + 1) % len(s.frames) {
+		if s.keyframe.Swap(false) && !s.frames[i].keyframe {
+			i = 0
+		}
+
+		write(media.Sample{Data: s.frames[i].data, Duration: s.frames[i].duration})
+
+		// Pace by the start of the loop, so sleeping late does not add up
+		next = next.Add(s.frames[i].duration)
+		timer.Reset(time.Until(next))
+		select {
+		case <-stopChan:
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// tickDuration converts clock ticks to a duration. It is rounded up, because the track truncates the duration to whole ticks.
+func tickDuration(ticks, clockRate uint64) time.Duration {
+	return time.Duration((ticks*uint64(time.Second) + clockRate - 1) / clockRate)
+}
+
+// opusSamples returns the number of 48 kHz samples of an Opus packet from its table of contents byte (RFC 6716 section 3.1)
+func opusSamples(packet []byte) (uint64, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty Opus packet")
+	}
+
+	config := packet[0] >> 3
+	var frameSamples uint64
+	switch {
+	case config < 12: // SILK 10, 20, 40, 60 ms
+		frameSamples = []uint64{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid 10, 20 ms
+		frameSamples = []uint64{480, 960}[config%2]
+	default: // CELT 2.5, 5, 10, 20 ms
+		frameSamples = []uint64{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 0x03 {
+	case 0:
+		return frameSamples, nil
+	case 1, 2:
+		return 2 * frameSamples, nil
+	}
+	if len(packet) < 2 {
+		return 0, errors.New("invalid Opus packet")
+	}
+	return uint64(packet[1]&0x3f) * frameSamples, nil
+}
@@ -0,0 +1,108 @@
+package video
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Every session gets the first codec of the profile (or of VIDEO_CODECS) its offer supports, e.g. vp9,h264,vp8 sends VP9 to Chrome
+// and H.264 to Safari. Each codec used by at least one session runs its own encoder, so only list codecs the CPU can afford.
+
+// defaultCodecs is used if neither the profile nor VIDEO_CODECS lists codecs
+var defaultCodecs = []string{"vp8"}
+
+// Codec describes a video codec and the ffmpeg encoder producing it
+type Codec struct {
+	Name       string
+	Capability webrtc.RTPCodecCapability
+	Encoder    []string // ffmpeg arguments selecting and tuning the encoder
+}
+
+// codecs lists the supported codecs by name
+var codecs = map[string]Codec{
+	"vp8": {
+		Name:       "vp8",
+		Capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		Encoder: []string{
+			"-c:v", "libvpx",
+			"-deadline", "realtime", // fastest encoding preset
+			"-cpu-used", "8", // minimal CPU usage
+		},
+	},
+	"vp9": {
+		Name:       "vp9",
+		Capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		Encoder: []string{
+			"-c:v", "libvpx-vp9",
+			"-deadline", "realtime",
+			"-cpu-used", "8",
+			"-row-mt", "1", // encode rows in parallel
+			"-strict", "experimental", // the VP9 RTP packetizer of ffmpeg is experimental
+		},
+	},
+	"h264": {
+		Name:       "h264",
+		Capability: h264Codec,
+		Encoder: []string{
+			"-c:v", "libx264",
+			"-preset", "ultrafast",
+			"-tune", "zerolatency",
+			"-profile:v", "baseline", // constrained baseline is decoded by every browser
+			"-pix_fmt", "yuv420p",
+		},
+	},
+	"av1": {
+		Name:       "av1",
+		Capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		Encoder: []string{
+			"-c:v", "libsvtav1", // the AV1 RTP packetizer needs ffmpeg 7 or newer
+			"-preset", "12", // fastest preset
+		},
+	},
+}
+
+// parseCodecs returns the codecs of VIDEO_CODECS or of the profile in order of priority
+func parseCodecs(profileCodecs []string) ([]Codec, error) {
+	names := profileCodecs
+	if value := os.Getenv("VIDEO_CODECS"); value != "" {
+		names = strings.Split(value, ",")
+	}
+	if len(names) == 0 {
+		names = defaultCodecs
+	}
+
+	var result []Codec
+	for _, name := range names {
+		codec, ok := codecs[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown video codec %q", name)
+		}
+		result = append(result, codec)
+	}
+	return result, nil
+}
+
+// selectCodec returns the first codec of the list, which is contained in the offered MIME types.
+// Without offered types the first codec is used.
+func selectCodec(priority []Codec, offered []string) (Codec, error) {
+	if len(offered) == 0 {
+		return priority[0], nil
+	}
+
+	for _, codec := range priority {
+		for _, mimeType := range offered {
+			if strings.EqualFold(mimeType, codec.Capability.MimeType) {
+				return codec, nil
+			}
+		}
+	}
+
+	names := make([]string, len(priority))
+	for i, codec := range priority {
+		names[i] = codec.Name
+	}
+	return Codec{}, fmt.Errorf("client supports none of the video codecs %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,244 @@
+package video
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+)
+
+// In H.264 pass-through mode (profile source h264) the video is not transcoded by ffmpeg. A hardware encoder writes an Annex-B
+// elementary stream to stdout of a child process (command of the profile) or to a named pipe or file (input of the profile), the NAL units
+// are grouped into frames and packetized in Go. Regular files, e.g. a recording of libcamera-vid, are played in a loop at the framerate.
+// The encoder has to repeat SPS/PPS before every keyframe (--inline for libcamera-vid) and send keyframes regularly,
+// otherwise sessions joining later never get a decodable frame. The quality ladder does not apply, the encoder keeps its settings.
+
+// defaultH264Framerate is used to pace recorded files and to time the first frame of a live stream
+const defaultH264Framerate = 30
+
+// h264Codec is the codec of the pass-through track, constrained baseline is decoded by every browser
+var h264Codec = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeH264,
+	ClockRate:   90000,
+	SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+}
+
+// annexBStartCode separates the NAL units of a frame, the payloader splits the sample at these start codes
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// streamH264 reads the H.264 stream of the configured source until streaming is stopped
+func (p *pipeline) streamH264(stopChan chan struct{}) error {
+	profile := p.handler.profile
+
+	framerate := defaultH264Framerate
+	if profile.Framerate > 0 {
+		framerate = profile.Framerate
+	}
+	frameDuration := time.Second / time.Duration(framerate)
+
+	path := profile.Input
+	if path == "" {
+		return p.streamH264Command(stopChan, frameDuration)
+	}
+
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to open H.264 file: %w", err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open H.264 file: %w", err)
+		}
+
+		// Close the file on stop, a read from a named pipe blocks until its producer writes
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-stopChan:
+				file.Close()
+			case <-done:
+			}
+		}()
+
+		// Only a regular file is paced and looped, a named pipe is written in real time by its producer
+		recorded := info.Mode().IsRegular()
+		err = p.readH264(file, stopChan, frameDuration, recorded)
+		close(done)
+		file.Close()
+
+		if err != nil || !recorded {
+			return err
+		}
+
+		select {
+		case <-stopChan:
+			return nil
+		default:
+		}
+	}
+}
+
+// streamH264Command reads the stream of the encoder command, which is restarted by the supervisor when it exits or stalls.
+// The stdout of all runs of the encoder is joined into one pipe, each run starts with parameter sets and a keyframe.
+func (p *pipeline) streamH264Command(stopChan chan struct{}, frameDuration time.Duration) error {
+	reader, writer := io.Pipe()
+	p.encoderOutput = writer
+
+	p.startSupervisor(stopChan)
+	go func() {
+		<-stopChan
+		writer.Close()
+	}()
+
+	return p.readH264(reader, stopChan, frameDuration, false)
+}
+
+// encoderCommand creates the H.264 encoder process of the profile, which writes to the pipe of streamH264Command
+func (p *pipeline) encoderCommand() *exec.Cmd {
+	fields := strings.Fields(p.handler.profile.Command)
+	encoder := exec.Command(fields[0], fields[1:]...)
+	encoder.Stdout = p.encoderOutput
+	return encoder
+}
+
+// readH264 reads the access units of the stream and writes them as frames to the tracks of the hub
+func (p *pipeline) readH264(stream io.Reader, stopChan chan struct{}, frameDuration time.Duration, paced bool) error {
+	reader := newAccessUnitReader(stream)
+
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	var lastFrame time.Time
+
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		default:
+		}
+
+		frame, err := reader.next()
+		if err != nil {
+			// The end of a recorded file or of the encoder output, or the pipe was closed as part of normal shutdown
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("H.264 read error: %w", err)
+		}
+
+		// Recorded streams are paced by the frame rate, live streams are timed by their arrival
+		duration := frameDuration
+		if paced {
+			select {
+			case <-stopChan:
+				return nil
+			case <-ticker.C:
+			}
+		} else if now := time.Now(); !lastFrame.IsZero() {
+			duration = now.Sub(lastFrame)
+			lastFrame = now
+		} else {
+			lastFrame = now
+		}
+
+		p.hub.WriteSample(media.Sample{Data: frame, Duration: duration})
+		if p.supervisor != nil {
+			p.supervisor.Touch()
+		}
+	}
+}
+
+// accessUnitReader groups the NAL units of an Annex-B stream into access units, the frames of the tracks.
+// An access unit ends before an access unit delimiter, parameter sets, SEI or the first slice of the next picture.
+// The first bytes after a start code decide this, so a live frame is complete as soon as the next one begins.
+type accessUnitReader struct {
+	reader *bufio.Reader
+	inNAL  bool // a NAL unit starts at the reader, its start code is already consumed
+}
+
+func newAccessUnitReader(stream io.Reader) *accessUnitReader {
+	return &accessUnitReader{reader: bufio.NewReader(stream)}
+}
+
+// next returns the next access unit in Annex-B format. Units before the first slice of the stream belong to its first access unit.
+func (r *accessUnitReader) next() ([]byte, error) {
+	var frame []byte
+	hasSlice := false
+	zeros := 0 // zero bytes not written yet, they are part of the next start code or of the unit
+
+	if r.inNAL {
+		header, _ := r.reader.Peek(2)
+		frame = append(frame, annexBStartCode...)
+		hasSlice = isSlice(header)
+	}
+
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			// The last access unit of the stream ends with the stream
+			if errors.Is(err, io.EOF) && hasSlice {
+				r.inNAL = false
+				return frame, nil
+			}
+			return nil, err
+		}
+
+		switch {
+		case b == 0:
+			zeros++
+		case b == 1 && zeros >= 2:
+			zeros = 0
+			r.inNAL = true
+			header, _ := r.reader.Peek(2)
+			if hasSlice && startsAccessUnit(header) {
+				return frame, nil
+			}
+			frame = append(frame, annexBStartCode...)
+			hasSlice = hasSlice || isSlice(header)
+		default:
+			// Bytes before the first start code are skipped
+			if r.inNAL {
+				for ; zeros > 0; zeros-- {
+					frame = append(frame, 0)
+				}
+				frame = append(frame, b)
+			}
+			zeros = 0
+		}
+	}
+}
+
+// isSlice reports whether the NAL unit starting with header is a slice of a picture
+func isSlice(header []byte) bool {
+	if len(header) == 0 {
+		return false
+	}
+	unitType := h264reader.NalUnitType(header[0] & 0x1F)
+	return unitType == h264reader.NalUnitTypeCodedSliceNonIdr || unitType == h264reader.NalUnitTypeCodedSliceIdr
+}
+
+// startsAccessUnit reports whether the NAL unit starting with header begins a new access unit after a slice (H.264 7.4.1.2.3)
+func startsAccessUnit(header []byte) bool {
+	if len(header) == 0 {
+		return false
+	}
+	switch h264reader.NalUnitType(header[0] & 0x1F) {
+	case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS, h264reader.NalUnitTypeSEI:
+		return true
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		// first_mb_in_slice is the first field of the slice header, its Exp-Golomb code of 0 is a single 1 bit
+		return len(header) > 1 && header[1]&0x80 != 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,216 @@
+package video
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// testdata/slices.h264 holds four access units with 3 and 4 byte start codes, like the inline headers of libcamera-vid:
+//   SPS PPS IDR IDR (the second slice of the picture starts at macroblock 40, its first slice has an emulation prevention byte)
+//   P P (two slices again)
+//   AUD SEI P
+//   SPS PPS IDR
+//
+// testdata/x264.h264 and testdata/gopro.h264 are recordings of real encoders, the samples of MP4 files converted to Annex-B
+// with the parameter sets of the file inline before every keyframe:
+//   x264.h264: 10 frames of x264 core 155 with B-frames (testdata/sample.mp4 of github.com/abema/go-mp4)
+//   gopro.h264: 3 frames of the GoPro AVC encoder with AUD and SEI (testdata/extractEmbedded.mp4 of github.com/barasher/go-exiftool)
+
+// nalTypes returns the NAL unit types of an access unit written by accessUnitReader
+func nalTypes(frame []byte) []byte {
+	var types []byte
+	for _, nal := range bytes.Split(frame, annexBStartCode)[1:] {
+		types = append(types, nal[0]&0x1F)
+	}
+	return types
+}
+
+// TestAccessUnits checks that the slices of a picture and the units before it are grouped into one access unit
+func TestAccessUnits(t *testing.T) {
+	data, err := os.ReadFile("testdata/slices.h264")
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	expected := [][]byte{{7, 8, 5, 5}, {1, 1}, {9, 6, 1}, {7, 8, 5}}
+
+	reader := newAccessUnitReader(bytes.NewReader(data))
+	for i, types := range expected {
+		frame, err := reader.next()
+		if err != nil {
+			t.Fatalf("access unit %d: %v", i, err)
+		}
+		if got := nalTypes(frame); !bytes.Equal(got, types) {
+			t.Fatalf("access unit %d has NAL units %v, expected %v", i, got, types)
+		}
+		if i == 0 && !bytes.Contains(frame, []byte{0x22, 0x00, 0x00, 0x03, 0x01}) {
+			t.Fatalf("access unit %d lost its emulation prevention byte: % x", i, frame)
+		}
+	}
+
+	if frame, err := reader.next(); err != io.EOF {
+		t.Fatalf("read % x and %v after the last access unit, expected EOF", frame, err)
+	}
+}
+
+// TestRecordedAccessUnits splits the streams of real encoders, the access units have to match the samples of the MP4 files
+func TestRecordedAccessUnits(t *testing.T) {
+	for _, test := range []struct {
+		file  string
+		count int
+		first []byte // NAL unit types of the first access unit
+	}{
+		{"testdata/x264.h264", 10, []byte{7, 8, 6, 5}},
+		{"testdata/gopro.h264", 3, []byte{9, 7, 8, 6, 5}},
+	} {
+		data, err := os.ReadFile(test.file)
+		if err != nil {
+			t.Fatalf("failed to read fixture: %v", err)
+		}
+
+		var nals [][]byte
+		reader := newAccessUnitReader(bytes.NewReader(data))
+		count := 0
+		for {
+			frame, err := reader.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: access unit %d: %v", test.file, count, err)
+			}
+			if count == 0 && !bytes.Equal(nalTypes(frame), test.first) {
+				t.Errorf("%s: first access unit has NAL units %v, expected %v", test.file, nalTypes(frame), test.first)
+			}
+			nals = append(nals, bytes.Split(frame, annexBStartCode)[1:]...)
+			count++
+		}
+
+		if count != test.count {
+			t.Errorf("%s: read %d access units, expected %d", test.file, count, test.count)
+		}
+		// The zeros at the end of a NAL unit are trailing_zero_8bits of the stream, the SPS of the GoPro ends with them
+		expected := bytes.Split(data, annexBStartCode)[1:]
+		if len(nals) != len(expected) {
+			t.Fatalf("%s: read %d NAL units, expected %d", test.file, len(nals), len(expected))
+		}
+		for i := range nals {
+			if !bytes.Equal(nals[i], bytes.TrimRight(expected[i], "\x00")) {
+				t.Errorf("%s: NAL unit %d differs from the stream", test.file, i)
+			}
+		}
+	}
+}
+
+// sampleTap records the samples written by the pipeline
+type sampleTap struct {
+	mutex   sync.Mutex
+	samples []media.Sample
+}
+
+func (s *sampleTap) WriteRTP(packet *rtp.Packet) error { return nil }
+
+func (s *sampleTap) WriteSample(sample media.Sample) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples = append(s.samples, sample)
+	return nil
+}
+
+// testPipeline returns a pipeline writing H.264 samples to the tap
+func testPipeline(tap hub.Tap) *pipeline {
+	p := &pipeline{hub: hub.New(h264Codec, "video", "camera", true, nil)}
+	p.hub.AddTap(tap)
+	return p
+}
+
+// TestReadH264Paced checks that a recorded file is played one access unit per frame duration
+func TestReadH264Paced(t *testing.T) {
+	file, err := os.Open("testdata/slices.h264")
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer file.Close()
+
+	tap := &sampleTap{}
+	frameDuration := 20 * time.Millisecond
+	start := time.Now()
+	if err := testPipeline(tap).readH264(file, make(chan struct{}), frameDuration, true); err != nil {
+		t.Fatalf("failed to read H.264: %v", err)
+	}
+
+	if len(tap.samples) != 4 {
+		t.Fatalf("wrote %d samples, expected 4", len(tap.samples))
+	}
+	for i, sample := range tap.samples {
+		if sample.Duration != frameDuration {
+			t.Errorf("sample %d lasts %v, expected %v", i, sample.Duration, frameDuration)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 4*frameDuration {
+		t.Errorf("played 4 frames in %v, expected at least %v", elapsed, 4*frameDuration)
+	}
+}
+
+// TestReadH264Live checks that a live stream is timed by the arrival of its access units
+func TestReadH264Live(t *testing.T) {
+	data, err := os.ReadFile("testdata/slices.h264")
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	// Split the fixture before every access unit, as an encoder writes it frame by frame
+	var frames [][]byte
+	reader := newAccessUnitReader(bytes.NewReader(data))
+	for {
+		frame, err := reader.next()
+		if err != nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+
+	stream, writer := io.Pipe()
+	interval := 50 * time.Millisecond
+	go func() {
+		for _, frame := range frames {
+			writer.Write(frame)
+			time.Sleep(interval)
+		}
+		writer.Close()
+	}()
+
+	tap := &sampleTap{}
+	frameDuration := 10 * time.Millisecond
+	if err := testPipeline(tap).readH264(stream, make(chan struct{}), frameDuration, false); err != nil {
+		t.Fatalf("failed to read H.264: %v", err)
+	}
+
+	if len(tap.samples) != len(frames) {
+		t.Fatalf("wrote %d samples, expected %d", len(tap.samples), len(frames))
+	}
+	for i, sample := range tap.samples {
+		if !bytes.Equal(sample.Data, frames[i]) {
+			t.Errorf("sample %d is % x, expected % x", i, sample.Data, frames[i])
+		}
+	}
+
+	// The first frame has no predecessor, the others are timed by the gap to the previous one
+	if tap.samples[0].Duration != frameDuration {
+		t.Errorf("first sample lasts %v, expected %v", tap.samples[0].Duration, frameDuration)
+	}
+	for i, sample := range tap.samples[1 : len(tap.samples)-1] {
+		if sample.Duration < interval/2 || sample.Duration > 2*interval {
+			t.Errorf("sample %d lasts %v, expected about %v", i+1, sample.Duration, interval)
+		}
+	}
+}
@@ -8,205 +8,431 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/profiles"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/supervisor"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/synthetic"
+
 	"github.com/pion/webrtc/v4"
 )
 
-const udpPort = 5004
+// keyframePeriod is the interval in seconds of the keyframes ffmpeg sends on its own, in case a keyframe request of a client is lost.
+// An encoder is restarted for a requested keyframe at most once per period, see restartForKeyframe.
+const keyframePeriod = 10
+
+// keyframeDueSoon is the time before the next periodic keyframe, in which a keyframe request does not restart the encoder
+const keyframeDueSoon = 2 * time.Second
+
+var (
+	packetsMetric  = metrics.NewCounterVec("controller_rtp_packets_forwarded_total", "RTP packets forwarded from ffmpeg to the WebRTC track.", "kind").With("video")
+	restartsMetric = metrics.NewCounterVec("controller_ffmpeg_restarts_total", "Restarts of the ffmpeg pipeline after its first start.", "kind").With("video")
+	keyframeMetric = metrics.NewCounter("controller_keyframes_forced_total", "Keyframes forced by requests of the clients.")
+)
 
 // Handler manages the video streaming functionality
 type Handler struct {
-	videoTrack  *webrtc.TrackLocalStaticRTP
-	stopChan    chan struct{}
-	isStreaming bool
+	profile     profiles.Profile
+	codecs      []Codec              // codecs in order of priority
+	pipelines   map[string]*pipeline // pipelines keyed by codec name, created with the first track of the codec
+	passthrough bool                 // H.264 pass-through, see h264.go
+	synthetic   *synthetic.Source    // embedded test pattern instead of an encoder, nil otherwise
+	external    bool                 // RTP of an external producer instead of ffmpeg
+	ingest      *net.UDPAddr         // receives the RTP of the first codec, the following codecs use the ports 10 apart
+	ladder      ladderState
+	onState     func(codec string, status supervisor.Status)
+	newTap      func(codec webrtc.RTPCodecCapability) hub.Tap // creates the recording tap of each pipeline, nil if not recording
+	mutex       sync.Mutex
 }
 
-// NewHandler creates a new video handler
+// pipeline encodes the video with one codec, its hub writes the stream to the tracks of all sessions that negotiated the codec
+type pipeline struct {
+	handler       *Handler
+	codec         Codec
+	ingest        *net.UDPAddr // address receiving the RTP, a free port is picked when listening if its port is 0
+	conn          *net.UDPConn // receives the RTP, opened with the first stream and kept, so a restart finds the port free
+	port          int          // port the RTP is received on
+	hub           *hub.Hub
+	tap           hub.Tap                // recording tap of the hub, nil if not recording
+	supervisor    *supervisor.Supervisor // runs ffmpeg or the H.264 encoder command, nil for the synthetic source and an external producer
+	encoderOutput io.Writer              // stdout of the H.264 encoder command, see h264.go
+	started       time.Time              // start of the current run of the encoder process, which begins with a keyframe
+	stopChan      chan struct{}          // closed to stop the current stream, every start gets a new one
+	done          chan struct{}          // closed when the goroutine of the last start ended
+	isStreaming   bool
+}
+
+// NewHandler creates a new video handler for the video profile selected by VIDEO_PROFILE
 func NewHandler() *Handler {
+	profile, err := profiles.Selected(profiles.KindVideo)
+	if err != nil {
+		log.Fatalf("failed to load video profile: %v", err)
+	}
+	log.Printf("Using video profile %s", profile)
+
+	passthrough := profile.Source == profiles.SourceH264
+
+	codecs, err := parseCodecs(profile.Codecs)
+	if err != nil {
+		log.Fatalf("failed to configure video codecs: %v", err)
+	}
+
+	// A pass-through encoder can only deliver H.264
+	if passthrough {
+		codecs = []Codec{{Name: "h264", Capability: h264Codec}}
+	}
+
+	// An external producer sends one stream, its codec is the first of the profile
+	external := profile.Source == profiles.SourceRTP
+	if external {
+		codecs = codecs[:1]
+	}
+
+	ingest, err := profile.IngestAddr()
+	if err != nil {
+		log.Fatalf("failed to configure video ingest: %v", err)
+	}
+
+	// The synthetic source plays an embedded VP8 sample
+	var source *synthetic.Source
+	if profile.Source == profiles.SourceSynthetic {
+		source, err = synthetic.Video()
+		if err != nil {
+			log.Fatalf("failed to load synthetic video: %v", err)
+		}
+		codecs = []Codec{{Name: "vp8", Capability: source.Codec()}}
+	}
+
+	// The profile defines the highest quality step, missing values are taken from the default ladder
+	top := Ladder[len(Ladder)-1]
+	if profile.Resolution != "" {
+		top.Width, top.Height, _ = profile.Size()
+	}
+	if profile.Framerate > 0 {
+		top.Framerate = profile.Framerate
+	}
+	if profile.Bitrate != "" {
+		top.Bitrate, _ = profile.BitsPerSecond()
+	}
+	steps := ladderFor(top)
+
 	return &Handler{
-		stopChan: make(chan struct{}),
+		profile:     profile,
+		codecs:      codecs,
+		pipelines:   make(map[string]*pipeline),
+		passthrough: passthrough,
+		synthetic:   source,
+		external:    external,
+		ingest:      ingest,
+		ladder:      ladderState{steps: steps, step: len(steps) - 1},
 	}
 }
 
-// CreateTrack creates a video track for WebRTC
-func (vh *Handler) CreateTrack() (*webrtc.TrackLocalStaticRTP, error) {
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
-		"video",
-		"camera",
-	)
+// CreateTrack returns a new video track of the best codec among the MIME types offered by the client (e.g. "video/VP9").
+// Every session gets its own track, the encoder of the codec runs once and feeds the tracks of all sessions.
+func (vh *Handler) CreateTrack(offered []string) (webrtc.TrackLocal, error) {
+	codec, err := selectCodec(vh.codecs, offered)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create video track: %w", err)
+		return nil, err
+	}
+
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	p, ok := vh.pipelines[codec.Name]
+	if !ok {
+		p = vh.newPipeline(codec)
+		vh.pipelines[codec.Name] = p
 	}
-	vh.videoTrack = videoTrack
-	return videoTrack, nil
+	return p.hub.NewTrack()
 }
 
-// StartStreaming starts the camera streaming process
-func (vh *Handler) StartStreaming() error {
-	if vh.isStreaming {
-		return errors.New("streaming already in progress")
+// newPipeline creates the pipeline of the codec, the encoder is started with the first viewer
+func (vh *Handler) newPipeline(codec Codec) *pipeline {
+	// A fixed port follows the priority of the codec, so it does not depend on the order the clients connect in
+	ingest := *vh.ingest
+	for i, configured := range vh.codecs {
+		if configured.Name == codec.Name && ingest.Port != 0 {
+			ingest.Port = vh.ingest.Port + 10*i
+		}
 	}
 
-	if vh.videoTrack == nil {
+	p := &pipeline{
+		handler:  vh,
+		codec:    codec,
+		ingest:   &ingest,
+		stopChan: make(chan struct{}),
+	}
+	p.hub = hub.New(codec.Capability, "video", "camera", vh.passthrough || vh.synthetic != nil, p.forceKeyframe)
+
+	switch {
+	case vh.synthetic != nil, vh.external:
+		// The sample is played in Go or the RTP comes from elsewhere, there is no process to supervise
+	case vh.passthrough:
+		p.supervisor = supervisor.New("video "+codec.Name, p.encoderCommand, p.reportState)
+	default:
+		p.supervisor = supervisor.New("video "+codec.Name, p.ffmpegCommand, p.reportState)
+	}
+	if vh.newTap != nil {
+		p.tap = vh.newTap(codec.Capability)
+		p.hub.AddTap(p.tap)
+	}
+	log.Printf("Created %s video pipeline", codec.Name)
+	return p
+}
+
+// Record passes the stream of every pipeline to a tap created by newTap for its codec, also for pipelines created later.
+// A nil newTap stops passing the streams to the taps.
+func (vh *Handler) Record(newTap func(codec webrtc.RTPCodecCapability) hub.Tap) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	vh.newTap = newTap
+	for _, p := range vh.pipelines {
+		if p.tap != nil {
+			p.hub.RemoveTap(p.tap)
+			p.tap = nil
+		}
+		if newTap != nil {
+			p.tap = newTap(p.codec.Capability)
+			p.hub.AddTap(p.tap)
+		}
+	}
+}
+
+// OnState registers a callback function that will be executed when the state of an encoder process changes.
+// The codec is the MIME type of the pipeline, e.g. "video/VP8".
+func (vh *Handler) OnState(callback func(codec string, status supervisor.Status)) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	vh.onState = callback
+}
+
+// reportState counts restarts and passes the state of the encoder process to the callback of the handler
+func (p *pipeline) reportState(status supervisor.Status) {
+	if status.State == supervisor.StateStarting && status.Attempt > 1 {
+		restartsMetric.Inc()
+	}
+
+	p.handler.mutex.Lock()
+	if status.State == supervisor.StateStarting {
+		p.started = time.Now()
+	}
+	callback := p.handler.onState
+	p.handler.mutex.Unlock()
+
+	if callback != nil {
+		callback(p.codec.Capability.MimeType, status)
+	}
+}
+
+// pipeline returns the pipeline feeding the track or nil
+func (vh *Handler) pipeline(track webrtc.TrackLocal) *pipeline {
+	codec, ok := track.(interface {
+		Codec() webrtc.RTPCodecCapability
+	})
+	if !ok {
+		return nil
+	}
+
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	for _, p := range vh.pipelines {
+		if p.codec.Capability.MimeType == codec.Codec().MimeType {
+			return p
+		}
+	}
+	return nil
+}
+
+// StartStreaming starts sending the video to the track. The encoder is started for the first track of its codec,
+// later tracks join the running stream and start decoding at its next keyframe.
+func (vh *Handler) StartStreaming(track webrtc.TrackLocal) error {
+	p := vh.pipeline(track)
+	if p == nil {
 		return errors.New("video track not created")
 	}
 
-	vh.stopChan = make(chan struct{})
-	vh.isStreaming = true
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	if !p.hub.Add(track) {
+		// An encoder would be restarted for all viewers, only the synthetic source sends a keyframe on request
+		if vh.synthetic != nil {
+			go p.hub.RequestKeyframe() // forceKeyframe takes the mutex
+		}
+		return nil
+	}
+
+	if p.isStreaming {
+		return errors.New("streaming already in progress")
+	}
+
+	stopChan := make(chan struct{})
+	p.stopChan = stopChan
+	p.isStreaming = true
+
+	stream := p.streamCamera
+	if vh.passthrough {
+		stream = p.streamH264
+	}
+	if vh.synthetic != nil {
+		stream = p.streamSynthetic
+	}
+
+	previous := p.done
+	done := make(chan struct{})
+	p.done = done
 
 	go func() {
-		if err := vh.streamCamera(); err != nil {
+		defer close(done)
+
+		// The stream of the previous start ends first, so two streams never write to the tracks at once
+		if previous != nil {
+			<-previous
+		}
+
+		if err := stream(stopChan); err != nil {
 			log.Printf("Camera streaming error: %v", err)
 		}
-		vh.isStreaming = false
+
+		// A stream stopped by StopStreaming may end after the next start, it must not reset the state of the new stream
+		vh.mutex.Lock()
+		defer vh.mutex.Unlock()
+		if p.stopChan == stopChan && p.isStreaming {
+			close(stopChan)
+			p.isStreaming = false
+			if p.supervisor != nil {
+				p.supervisor.Stop()
+			}
+		}
 	}()
 
+	log.Printf("Started %s video pipeline", p.codec.Name)
 	return nil
 }
 
-// StopStreaming stops the streaming process
-func (vh *Handler) StopStreaming() {
-	if vh.isStreaming {
-		close(vh.stopChan)
-		vh.isStreaming = false
+// StopStreaming stops sending the video to the track, the encoder is stopped after the last track of its codec
+func (vh *Handler) StopStreaming(track webrtc.TrackLocal) {
+	p := vh.pipeline(track)
+	if p == nil {
+		return
+	}
+
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+
+	if p.hub.Remove(track) && p.isStreaming {
+		close(p.stopChan)
+		p.isStreaming = false
+		if p.supervisor != nil {
+			p.supervisor.Stop()
+		}
+		log.Printf("Stopped %s video pipeline", p.codec.Name)
 	}
 }
 
-// streamCamera handles the camera capture and streaming
-func (vh *Handler) streamCamera() error {
-	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
+// RequestKeyframe asks the encoder feeding the track for a keyframe, e.g. after a picture loss indication of the client
+func (vh *Handler) RequestKeyframe(track webrtc.TrackLocal) {
+	if p := vh.pipeline(track); p != nil {
+		p.hub.RequestKeyframe()
 	}
+}
 
-	udpConn, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP port %d: %w", udpPort, err)
+// forceKeyframe makes the encoder send a keyframe, it is rate limited by the hub.
+// ffmpeg cannot be asked for a keyframe while it runs, it is restarted with -force_key_frames, which makes the first frame a keyframe.
+// A hardware encoder starts with parameter sets and a keyframe as well. A restart interrupts the video of all viewers,
+// so it is limited further by restartForKeyframe. A recorded H.264 file has to wait for its next keyframe.
+// The synthetic source continues at a keyframe of its sample. An external producer has to send keyframes on its own.
+func (p *pipeline) forceKeyframe() {
+	if p.handler.synthetic != nil {
+		p.handler.synthetic.RequestKeyframe()
+		return
+	}
+	if p.handler.external || (p.handler.passthrough && p.handler.profile.Command == "") {
+		return
 	}
-	defer udpConn.Close()
 
-	// Setup FFmpeg to capture directly from the camera and stream as RTP
-	var ffmpeg *exec.Cmd
+	p.handler.mutex.Lock()
+	streaming := p.isStreaming
+	running := time.Since(p.started)
+	p.handler.mutex.Unlock()
+	if !streaming || !restartForKeyframe(running) {
+		return
+	}
 
-	ffmpegBinary := os.Getenv("FFMPEG_BINARY")
-	if ffmpegBinary == "" {
-		ffmpegBinary = "ffmpeg"
+	log.Printf("Restarting %s video encoder for a keyframe", p.codec.Name)
+	keyframeMetric.Inc()
+	p.supervisor.Restart()
+}
+
+// restartForKeyframe reports whether an encoder, which has been running for the given time, is restarted for a requested keyframe.
+// A run begins with a keyframe and sends one every keyframePeriod, so the encoder is restarted at most once per period
+// and not at all if its next periodic keyframe is due soon.
+func restartForKeyframe(running time.Duration) bool {
+	period := keyframePeriod * time.Second
+	if running < period {
+		return false
 	}
+	return period-running%period >= keyframeDueSoon
+}
 
-	ffmpegLogLevel := os.Getenv("FFMPEG_LOG_LEVEL")
-	if ffmpegLogLevel == "" {
-		ffmpegLogLevel = "error"
+// startSupervisor starts the encoder process of the stream, unless the stream was already stopped.
+// StopStreaming stops the process under the same mutex, so a stopped stream cannot start it again.
+func (p *pipeline) startSupervisor(stopChan chan struct{}) {
+	p.handler.mutex.Lock()
+	defer p.handler.mutex.Unlock()
+
+	select {
+	case <-stopChan:
+	default:
+		p.supervisor.Start()
 	}
+}
 
-	switch videoMode := os.Getenv("VIDEO_MODE"); videoMode {
-	case "linux": // LINUX
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",      // removes version/config dump
-			"-nostats",          // removes the periodic "time=... bitrate=..." progress lines
-			"-i", "/dev/video0", // input device
-			"-c:v", "libvpx", // use VP8 codec
-			"-deadline", "realtime", // good quality encoding preset (use 'realtime' for better performance or 'best' for better quality)
-			"-cpu-used", "8", // moderate CPU usage for better quality (up to 8 for best performance)
-			"-video_size", "640x480", // video resolution
-			"-framerate", "30", // frame rate
-			"-b:v", "1.5M", // Bitrate
-			"-an",       // Disable audio
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "linux-work": // UBUNTU ARBEIT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner",      // removes version/config dump
-			"-nostats",          // removes the periodic "time=... bitrate=..." progress lines
-			"-i", "/dev/video0", // input device
-			"-c:v", "libvpx", // use VP8 codec
-			"-deadline", "realtime", // good quality encoding preset (use 'realtime' for better performance or 'best' for better quality)
-			"-cpu-used", "8", // moderate CPU usage for better quality (up to 8 for best performance)
-			"-video_size", "640x480", // video resolution
-			"-framerate", "30", // frame rate
-			"-b:v", "1.5M", // Bitrate
-			"-an",       // Disable audio
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "windows-work": // WINDOWS ARBEIT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner", // removes version/config dump
-			"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "dshow",  // input mode
-			"-i", "video=HP HD Camera", // input device
-			"-c:v", "libvpx", // use VP8 codec
-			"-deadline", "realtime", // fastest encoding preset
-			"-cpu-used", "8", // minimal CPU usage
-			"-video_size", "640x480", // video resolution
-			"-framerate", "30", // frame rate
-			"-b:v", "1.5M", // Bitrate
-			"-an",       // Disable audio
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	case "windows-privat": // WINDOWS PRIVAT
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner", // removes version/config dump
-			"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
-			"-f", "dshow",  // input mode
-			"-i", "video=HP Wide Vision 9MP camera", // input device
-			"-c:v", "libvpx", // use VP8 codec
-			"-deadline", "realtime", // fastest encoding preset
-			"-cpu-used", "8", // minimal CPU usage
-			"-video_size", "640x480", // video resolution
-			"-framerate", "30", // frame rate
-			"-b:v", "1.5M", // Bitrate
-			"-an",       // Disable audio
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	default: // VIDEO
-		ffmpeg = exec.Command(
-			ffmpegBinary,
-			"-loglevel", ffmpegLogLevel,
-			"-hide_banner", // removes version/config dump
-			"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
-			"-re",          // realtime speed
-			"-f", "lavfi", "-i", "testsrc=size=640x480:rate=30",
-			"-c:v", "libvpx", // use VP8 codec
-			"-deadline", "realtime", // good quality encoding preset (use 'realtime' for better performance or 'best' for better quality)
-			"-cpu-used", "8", // moderate CPU usage for better quality (up to 8 for best performance)
-			"-video_size", "640x480", // video resolution
-			"-framerate", "30", // frame rate
-			"-b:v", "1.5M", // Bitrate
-			"-an",       // Disable audio
-			"-f", "rtp", // RTP output format
-			fmt.Sprintf("rtp://127.0.0.1:%d", udpPort), // output URL
-		)
-	}
-
-	ffmpeg.Stdout = io.Discard // all logs in ffmpeg go to stderr
-	ffmpeg.Stderr = log.Writer()
-
-	// Start the FFmpeg process
-	if err := ffmpeg.Start(); err != nil {
-		return fmt.Errorf("ffmpeg start error: %w", err)
-	}
-
-	// Setup cleanup to ensure ffmpeg process is terminated
-	go func() {
-		<-vh.stopChan
-		if err := ffmpeg.Process.Kill(); err != nil {
-			log.Printf("Error killing FFmpeg process: %v", err)
-		}
-		udpConn.Close()
-	}()
+// listen returns the UDP connection receiving the RTP, it is opened on first use
+func (p *pipeline) listen() (*net.UDPConn, error) {
+	p.handler.mutex.Lock()
+	defer p.handler.mutex.Unlock()
+
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	conn, err := net.ListenUDP("udp", p.ingest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP address %s: %w", p.ingest, err)
+	}
+
+	// A free port is only known after listening, ffmpeg is started afterwards and sends to it
+	p.conn = conn
+	p.port = conn.LocalAddr().(*net.UDPAddr).Port
+	log.Printf("Receiving %s video RTP on %s", p.codec.Name, conn.LocalAddr())
+	return conn, nil
+}
+
+// streamSynthetic plays the embedded test pattern until streaming is stopped
+func (p *pipeline) streamSynthetic(stopChan chan struct{}) error {
+	return p.handler.synthetic.Play(p.hub.WriteSample, stopChan)
+}
+
+// streamCamera forwards the RTP received on the ingest address, which ffmpeg or an external producer sends
+func (p *pipeline) streamCamera(stopChan chan struct{}) error {
+	udpConn, err := p.listen()
+	if err != nil {
+		return err
+	}
+
+	// The supervisor restarts ffmpeg when it exits, stalls or the quality changes
+	if p.supervisor != nil {
+		p.startSupervisor(stopChan)
+	}
 
 	// Buffer for reading RTP packets (1500 bytes is typical MTU size)
 	buffer := make([]byte, 1500)
@@ -214,13 +440,13 @@ func (vh *Handler) streamCamera() error {
 	// Read RTP packets from UDP and forward to WebRTC
 	for {
 		select {
-		case <-vh.stopChan:
+		case <-stopChan:
 			return nil
 		default:
 			// Set read deadline to allow periodic stop checks
 			udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 
-			n, _, err := udpConn.ReadFrom(buffer)
+			n, addr, err := udpConn.ReadFrom(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -234,10 +460,67 @@ func (vh *Handler) streamCamera() error {
 				return fmt.Errorf("UDP read error: %w", err)
 			}
 
-			// Write raw RTP packet to WebRTC track
-			if _, err := vh.videoTrack.Write(buffer[:n]); err != nil {
-				return fmt.Errorf("RTP write error: %w", err)
+			// Write raw RTP packet to the tracks of all sessions, a stray datagram must not end the stream of the viewers
+			if err := p.hub.Write(buffer[:n]); err != nil {
+				log.Printf("Dropped %s video packet from %s: %v", p.codec.Name, addr, err)
+				continue
+			}
+			packetsMetric.Inc()
+			if p.supervisor != nil {
+				p.supervisor.Touch()
 			}
 		}
 	}
 }
+
+// ffmpegCommand creates the ffmpeg process with the codec of the pipeline and the current quality, which sends the encoded video as RTP to the ingest address
+func (p *pipeline) ffmpegCommand() *exec.Cmd {
+	quality := p.handler.Quality()
+
+	ffmpegBinary := os.Getenv("FFMPEG_BINARY")
+	if ffmpegBinary == "" {
+		ffmpegBinary = "ffmpeg"
+	}
+
+	ffmpegLogLevel := os.Getenv("FFMPEG_LOG_LEVEL")
+	if ffmpegLogLevel == "" {
+		ffmpegLogLevel = "error"
+	}
+
+	profile := p.handler.profile
+
+	// An ingest address listening on all interfaces is reached on the loopback interface
+	host := "127.0.0.1"
+	if p.ingest.IP != nil && !p.ingest.IP.IsUnspecified() {
+		host = p.ingest.IP.String()
+	}
+
+	// Setup FFmpeg to capture the input of the profile and stream as RTP
+	args := []string{
+		"-loglevel", ffmpegLogLevel,
+		"-hide_banner", // removes version/config dump
+		"-nostats",     // removes the periodic "time=... bitrate=..." progress lines
+	}
+	args = append(args, profile.InputArgs...)
+	if profile.Format != "" {
+		args = append(args, "-f", profile.Format) // input mode
+	}
+	args = append(args, "-i", profile.Input) // input device
+	args = append(args, p.codec.Encoder...)
+	args = append(args,
+		"-s", quality.Size(), // video resolution of the current quality step
+		"-r", strconv.Itoa(quality.Framerate), // frame rate of the current quality step
+		"-b:v", strconv.Itoa(quality.Bitrate), // Bitrate of the current quality step
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", keyframePeriod), // keyframe on the first frame and then periodically
+	)
+	args = append(args, profile.ExtraArgs...)
+	args = append(args,
+		"-an",       // Disable audio
+		"-f", "rtp", // RTP output format
+		"rtp://"+net.JoinHostPort(host, strconv.Itoa(p.port)), // output URL
+	)
+
+	ffmpeg := exec.Command(ffmpegBinary, args...)
+	ffmpeg.Stdout = io.Discard // all logs in ffmpeg go to stderr, which is read by the supervisor
+	return ffmpeg
+}
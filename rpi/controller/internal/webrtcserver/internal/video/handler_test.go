@@ -0,0 +1,104 @@
+package video
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// countingTap counts the samples written by the pipeline
+type countingTap struct {
+	samples atomic.Int64
+}
+
+func (c *countingTap) WriteRTP(packet *rtp.Packet) error { return nil }
+
+func (c *countingTap) WriteSample(sample media.Sample) error {
+	c.samples.Add(1)
+	return nil
+}
+
+// TestRestartBackToBack stops and starts the pipeline of the synthetic source without a pause,
+// the stream of the stopped start must neither reset the state of the new one nor keep running
+func TestRestartBackToBack(t *testing.T) {
+	t.Setenv("PROFILES_FILE", "")
+	t.Setenv("VIDEO_PROFILE", "test")
+	t.Setenv("VIDEO_CODECS", "")
+
+	vh := NewHandler()
+	tap := &countingTap{}
+	vh.Record(func(codec webrtc.RTPCodecCapability) hub.Tap { return tap })
+
+	track, err := vh.CreateTrack([]string{webrtc.MimeTypeVP8})
+	if err != nil {
+		t.Fatalf("failed to create track: %v", err)
+	}
+	p := vh.pipeline(track)
+
+	streaming := func() bool {
+		vh.mutex.Lock()
+		defer vh.mutex.Unlock()
+		return p.isStreaming
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := vh.StartStreaming(track); err != nil {
+			t.Fatalf("failed to start streaming: %v", err)
+		}
+		vh.StopStreaming(track)
+		if err := vh.StartStreaming(track); err != nil {
+			t.Fatalf("failed to restart streaming: %v", err)
+		}
+
+		// The stopped stream ends meanwhile
+		time.Sleep(50 * time.Millisecond)
+		if !streaming() {
+			t.Fatalf("run %d: pipeline is not streaming after a restart", i)
+		}
+
+		vh.StopStreaming(track)
+		if streaming() {
+			t.Fatalf("run %d: pipeline is still streaming after the stop", i)
+		}
+	}
+
+	// A single loop plays the 30 fps sample, a loop left running by an earlier start would add its frames
+	if err := vh.StartStreaming(track); err != nil {
+		t.Fatalf("failed to start streaming: %v", err)
+	}
+	defer vh.StopStreaming(track)
+
+	time.Sleep(100 * time.Millisecond)
+	before := tap.samples.Load()
+	time.Sleep(time.Second)
+	if frames := tap.samples.Load() - before; frames < 20 || frames > 40 {
+		t.Fatalf("played %d frames in a second, expected 30", frames)
+	}
+}
+
+// TestRestartForKeyframe checks that the encoder is restarted at most once per keyframe period and not right before a periodic keyframe
+func TestRestartForKeyframe(t *testing.T) {
+	for _, test := range []struct {
+		running time.Duration
+		restart bool
+	}{
+		{0, false},
+		{5 * time.Second, false},
+		{9 * time.Second, false},
+		{10 * time.Second, true},
+		{15 * time.Second, true},
+		{18 * time.Second, true},
+		{19 * time.Second, false},
+		{25 * time.Second, true},
+	} {
+		if restart := restartForKeyframe(test.running); restart != test.restart {
+			t.Errorf("restart after %v is %t, expected %t", test.running, restart, test.restart)
+		}
+	}
+}
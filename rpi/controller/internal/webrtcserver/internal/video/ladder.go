@@ -0,0 +1,165 @@
+package video
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// The encoder settings follow the bandwidth estimate of the peer connections along a ladder of quality steps.
+// Stepping down happens quickly, stepping up only after the estimate stayed above the next step for a while,
+// so the encoder is not restarted on every fluctuation of the estimate.
+// The estimator never exceeds 1.5x the received rate and the encoder uses the headroom of the estimate, so the next step
+// is only reachable if it is at most 1.35x the current one. Consecutive steps differ by at most maxStepRatio.
+
+// Quality is one step of the quality ladder
+type Quality struct {
+	Width     int
+	Height    int
+	Framerate int
+	Bitrate   int // bits per second
+}
+
+// Size returns the resolution in the WIDTHxHEIGHT form of ffmpeg
+func (q Quality) Size() string {
+	return fmt.Sprintf("%dx%d", q.Width, q.Height)
+}
+
+// Ladder lists the default quality steps from lowest to highest, the highest step is used until an estimate is available.
+// The profile replaces the highest step, steps above it are dropped, see ladderFor.
+var Ladder = []Quality{
+	{Width: 320, Height: 240, Framerate: 15, Bitrate: 250_000},
+	{Width: 320, Height: 240, Framerate: 30, Bitrate: 325_000},
+	{Width: 480, Height: 360, Framerate: 30, Bitrate: 420_000},
+	{Width: 480, Height: 360, Framerate: 30, Bitrate: 540_000},
+	{Width: 640, Height: 480, Framerate: 30, Bitrate: 700_000},
+	{Width: 640, Height: 480, Framerate: 30, Bitrate: 900_000},
+	{Width: 640, Height: 480, Framerate: 30, Bitrate: 1_160_000},
+	{Width: 640, Height: 480, Framerate: 30, Bitrate: 1_500_000},
+}
+
+const (
+	downHold       = 2 * time.Second  // the estimate has to stay below the current step this long before stepping down
+	upHold         = 10 * time.Second // the estimate has to stay above the next step this long before stepping up
+	headroom       = 0.9              // share of the estimate the encoder may use
+	minStepChanges = 3 * time.Second  // minimum time between two step changes
+	maxStepRatio   = 1.3              // maximum bitrate ratio of consecutive steps, below 1.35 for encoders falling short of their bitrate
+)
+
+// ladderFor returns the steps of Ladder below the top quality followed by the top quality.
+// Where the top quality is out of reach of the step below, steps with its resolution and framerate are inserted.
+func ladderFor(top Quality) []Quality {
+	var steps []Quality
+	for _, q := range Ladder {
+		if q.Bitrate < top.Bitrate && q.Width <= top.Width && q.Height <= top.Height && q.Framerate <= top.Framerate {
+			steps = append(steps, q)
+		}
+	}
+
+	if len(steps) > 0 {
+		below := steps[len(steps)-1].Bitrate
+		ratio := float64(top.Bitrate) / float64(below)
+		count := int(math.Ceil(math.Log(ratio)/math.Log(maxStepRatio) - 1e-9))
+		for i := 1; i < count; i++ {
+			q := top
+			q.Bitrate = int(float64(below) * math.Pow(ratio, float64(i)/float64(count)))
+			steps = append(steps, q)
+		}
+	}
+	return append(steps, top)
+}
+
+// ladderState selects the step of the ladder with hysteresis
+type ladderState struct {
+	steps      []Quality
+	step       int
+	lastChange time.Time
+	downSince  time.Time // zero while the estimate fits the current step
+	upSince    time.Time // zero while the estimate does not fit the next step
+}
+
+// next returns the step for the estimate at the given time
+func (ls *ladderState) next(estimate int, now time.Time) int {
+	usable := int(float64(estimate) * headroom)
+
+	if ls.steps[ls.step].Bitrate > usable {
+		ls.upSince = time.Time{}
+		if ls.downSince.IsZero() {
+			ls.downSince = now
+		}
+		if now.Sub(ls.downSince) < downHold || now.Sub(ls.lastChange) < minStepChanges {
+			return ls.step
+		}
+
+		// Step down to the highest step that fits, the lowest step is used if none fits
+		step := 0
+		for i := ls.step - 1; i > 0; i-- {
+			if ls.steps[i].Bitrate <= usable {
+				step = i
+				break
+			}
+		}
+		return ls.change(step, now)
+	}
+	ls.downSince = time.Time{}
+
+	if ls.step == len(ls.steps)-1 || ls.steps[ls.step+1].Bitrate > usable {
+		ls.upSince = time.Time{}
+		return ls.step
+	}
+	if ls.upSince.IsZero() {
+		ls.upSince = now
+	}
+	if now.Sub(ls.upSince) < upHold || now.Sub(ls.lastChange) < minStepChanges {
+		return ls.step
+	}
+
+	// Step up one step at a time, the estimate follows the higher rate before the next step
+	return ls.change(ls.step+1, now)
+}
+
+func (ls *ladderState) change(step int, now time.Time) int {
+	ls.step = step
+	ls.lastChange = now
+	ls.downSince = time.Time{}
+	ls.upSince = time.Time{}
+	return step
+}
+
+// Quality returns the current encoder settings
+func (vh *Handler) Quality() Quality {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+	return vh.ladder.steps[vh.ladder.step]
+}
+
+// SetTargetBitrate feeds a bandwidth estimate in bits per second into the ladder.
+// The encoder is restarted with the new settings if the step changes while streaming.
+func (vh *Handler) SetTargetBitrate(bitrate int) {
+	// A pass-through encoder, the synthetic source and an external producer keep their own settings
+	if vh.passthrough || vh.synthetic != nil || vh.external {
+		return
+	}
+
+	vh.mutex.Lock()
+	previous := vh.ladder.step
+	step := vh.ladder.next(bitrate, time.Now())
+	vh.mutex.Unlock()
+
+	if step == previous {
+		return
+	}
+
+	quality := vh.Quality()
+	log.Printf("Video quality changed to %s@%d %d kbit/s (estimate %d kbit/s)", quality.Size(), quality.Framerate, quality.Bitrate/1000, bitrate/1000)
+
+	// Restart the encoders with the new settings, a pipeline which is not streaming picks them up with its next start
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+	for _, p := range vh.pipelines {
+		if p.supervisor != nil {
+			p.supervisor.Restart()
+		}
+	}
+}
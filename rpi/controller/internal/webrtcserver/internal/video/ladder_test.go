@@ -0,0 +1,67 @@
+package video
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLadderFor checks that every step of the ladder is reachable from the step below
+func TestLadderFor(t *testing.T) {
+	for _, top := range []Quality{
+		Ladder[len(Ladder)-1],
+		{Width: 640, Height: 480, Framerate: 30, Bitrate: 1_200_000},
+		{Width: 1280, Height: 720, Framerate: 30, Bitrate: 4_000_000},
+		{Width: 320, Height: 240, Framerate: 15, Bitrate: 200_000},
+	} {
+		steps := ladderFor(top)
+		if steps[len(steps)-1] != top {
+			t.Errorf("top %v: ladder ends with %v", top, steps[len(steps)-1])
+		}
+		for i := 1; i < len(steps); i++ {
+			if ratio := float64(steps[i].Bitrate) / float64(steps[i-1].Bitrate); ratio <= 1 || ratio > maxStepRatio {
+				t.Errorf("top %v: step %d is %.2fx step %d", top, i, ratio, i-1)
+			}
+		}
+	}
+}
+
+// TestLadderNext feeds the estimate of a congestion controller into the ladder. Like GCC, the estimate
+// follows the capacity of the link but never exceeds 1.5x the bitrate the encoder sends.
+func TestLadderNext(t *testing.T) {
+	steps := ladderFor(Ladder[len(Ladder)-1])
+	top := len(steps) - 1
+
+	for _, test := range []struct {
+		name     string
+		capacity func(second int) int // capacity of the link in bits per second
+		want     int                  // step after two minutes
+	}{
+		{"steady", func(int) int { return 5_000_000 }, top},
+		{"persistently low", func(int) int { return 600_000 }, 3},
+		{"below the lowest step", func(int) int { return 100_000 }, 0},
+		{"down and up again", func(second int) int {
+			if second < 10 {
+				return 400_000
+			}
+			return 5_000_000
+		}, top},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ls := ladderState{steps: steps, step: top}
+			start := time.Now()
+			lowest := top
+			for second := 0; second < 120; second++ {
+				estimate := min(test.capacity(second), steps[ls.step].Bitrate*3/2)
+				step := ls.next(estimate, start.Add(time.Duration(second)*time.Second))
+				lowest = min(lowest, step)
+			}
+
+			if ls.step != test.want {
+				t.Errorf("ended at step %d, expected %d", ls.step, test.want)
+			}
+			if test.want == top && test.name != "steady" && lowest == top {
+				t.Error("did not step down")
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Media of a session can be toggled at runtime.
+// The client requests the tracks it wants with the transceivers of its offer (request-video / request-audio of the web component),
+// afterwards each track can be switched over the data channel:
+//   MEDIA VIDEO ON | MEDIA VIDEO OFF | MEDIA AUDIO ON | MEDIA AUDIO OFF
+// The server replies with the resulting state (e.g. MEDIA VIDEO OFF) or with MEDIA ERROR <reason>.
+// Every session gets its own track, one media pipeline (ffmpeg) per codec feeds the tracks of all sessions through a hub.
+// A pipeline only runs while at least one connected session receives it, keyframe requests of the clients are forwarded to its encoder.
+// The state of the pipeline (starting, running, backoff, failed, stopped) is pushed to the sessions receiving its track
+// as typed "media_state" message, e.g. {"kind":"video","codec":"video/VP8","state":"backoff","reason":"input device disconnected","retryInMs":4000}.
+
+package webrtcserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/supervisor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// mediaPrefix marks data channel messages that toggle the media of a session
+const mediaPrefix = "MEDIA "
+
+// mediaKinds lists the track kinds the server can send
+var mediaKinds = []string{"video", "audio"}
+
+// mediaHandler is implemented by the video and audio handlers.
+// CreateTrack creates the track of one session with the codec picked among the MIME types offered by the client,
+// StartStreaming and StopStreaming add and remove it from the pipeline of its codec.
+type mediaHandler interface {
+	CreateTrack(offered []string) (webrtc.TrackLocal, error)
+	StartStreaming(track webrtc.TrackLocal) error
+	StopStreaming(track webrtc.TrackLocal)
+	RequestKeyframe(track webrtc.TrackLocal)
+	OnState(callback func(codec string, status supervisor.Status))
+	Record(newTap func(codec webrtc.RTPCodecCapability) hub.Tap) // see recorder.go
+}
+
+// mediaState is the state of a media pipeline pushed to the client
+type mediaState struct {
+	Kind    string `json:"kind"`
+	Codec   string `json:"codec"`
+	State   string `json:"state"`
+	Reason  string `json:"reason,omitempty"`
+	Attempt int    `json:"attempt"`
+	RetryIn int64  `json:"retryInMs,omitempty"`
+}
+
+// mediaHandler returns the handler of the given track kind or nil if the kind is disabled
+func (s *Server) mediaHandler(kind string) mediaHandler {
+	switch kind {
+	case "video":
+		if s.videoEnabled && s.videoHandler != nil {
+			return s.videoHandler
+		}
+	case "audio":
+		if s.audioEnabled && s.audioHandler != nil {
+			return s.audioHandler
+		}
+	}
+	return nil
+}
+
+// offerMedia returns the media kinds ("video", "audio") the offer contains with the MIME types of their codecs (e.g. "video/VP8")
+func offerMedia(offerSDP string) (map[string][]string, error) {
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(offerSDP); err != nil {
+		return nil, fmt.Errorf("failed to parse offer: %w", err)
+	}
+
+	kinds := make(map[string][]string)
+	for _, media := range description.MediaDescriptions {
+		kind := media.MediaName.Media
+		mimeTypes := kinds[kind]
+
+		// rtpmap attributes look like "96 VP8/90000"
+		for _, attribute := range media.Attributes {
+			if attribute.Key != "rtpmap" {
+				continue
+			}
+			fields := strings.Fields(attribute.Value)
+			if len(fields) != 2 {
+				continue
+			}
+			encoding, _, _ := strings.Cut(fields[1], "/")
+			mimeTypes = append(mimeTypes, kind+"/"+encoding)
+		}
+		kinds[kind] = mimeTypes
+	}
+	return kinds, nil
+}
+
+// SetVideo switches the video track of a session at runtime.
+// Sessions with WebSocket signaling are renegotiated, other sessions need a video transceiver from their offer.
+func (s *Server) SetVideo(sessionID string, enabled bool) error {
+	return s.setMedia(sessionID, "video", enabled)
+}
+
+// SetAudio switches the audio track of a session at runtime.
+// Sessions with WebSocket signaling are renegotiated, other sessions need an audio transceiver from their offer.
+func (s *Server) SetAudio(sessionID string, enabled bool) error {
+	return s.setMedia(sessionID, "audio", enabled)
+}
+
+func (s *Server) setMedia(sessionID, kind string, enabled bool) error {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	handler := s.mediaHandler(kind)
+	if handler == nil {
+		return fmt.Errorf("%s is not enabled", kind)
+	}
+
+	sess.mutex.Lock()
+	renegotiable := sess.signaling != nil
+	negotiated := sess.senders[kind] != nil
+	offered := sess.offeredCodecs[kind]
+	on := sess.tracksOn[kind]
+	previous := sess.tracks[kind]
+	sess.mutex.Unlock()
+
+	// A new track would restart the stream of the session
+	if enabled && on {
+		return nil
+	}
+
+	var err error
+	switch {
+	case renegotiable && enabled:
+		track, trackErr := handler.CreateTrack(offered)
+		if trackErr != nil {
+			return trackErr
+		}
+		var sender *webrtc.RTPSender
+		if sender, err = sess.addTrack(kind, track); sender != nil {
+			go s.readRTCP(kind, sender)
+		}
+	case renegotiable:
+		err = sess.removeTrack(kind)
+	case !negotiated:
+		return fmt.Errorf("session %s did not request %s and cannot be renegotiated", sessionID, kind)
+	case enabled && previous != nil:
+		// The sender keeps its SSRC, a new track would start at random sequence numbers, which SRTP drops as replayed
+		err = sess.replaceTrack(kind, previous)
+	case enabled:
+		track, trackErr := handler.CreateTrack(offered)
+		if trackErr != nil {
+			return trackErr
+		}
+		err = sess.replaceTrack(kind, track)
+	default:
+		err = sess.replaceTrack(kind, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.syncMedia(sess)
+	return nil
+}
+
+// handleMediaMessage processes a MEDIA message of the data channel
+func (s *Server) handleMediaMessage(sess *Session, message string) {
+	fields := strings.Fields(strings.TrimPrefix(message, mediaPrefix))
+	if len(fields) != 2 || (fields[1] != "ON" && fields[1] != "OFF") {
+		sess.sendText(mediaPrefix + "ERROR invalid command")
+		return
+	}
+
+	kind := strings.ToLower(fields[0])
+	enabled := fields[1] == "ON"
+
+	if err := s.setMedia(sess.id, kind, enabled); err != nil {
+		sess.sendText(mediaPrefix + "ERROR " + err.Error())
+		return
+	}
+
+	sess.sendText(mediaPrefix + fields[0] + " " + fields[1])
+}
+
+// syncMedia acquires or releases the media pipelines the session needs.
+// A session needs the pipeline of its track while it is connected and sends the track.
+func (s *Server) syncMedia(sess *Session) {
+	for _, kind := range mediaKinds {
+		sess.mutex.Lock()
+		var want webrtc.TrackLocal
+		if sess.connected && !sess.closed && sess.tracksOn[kind] {
+			want = sess.tracks[kind]
+		}
+		held := sess.mediaHeld[kind]
+		if want != nil {
+			sess.mediaHeld[kind] = want
+		} else {
+			delete(sess.mediaHeld, kind)
+		}
+		sess.mutex.Unlock()
+
+		if want == held {
+			continue
+		}
+		if held != nil {
+			s.releaseMedia(kind, held)
+		}
+		if want != nil {
+			s.acquireMedia(sess, kind, want)
+		}
+	}
+}
+
+// acquireMedia adds the track to its media pipeline, which is started for the first session.
+// Sessions joining a running pipeline get its current state.
+func (s *Server) acquireMedia(sess *Session, kind string, track webrtc.TrackLocal) {
+	s.mutex.Lock()
+	state, known := s.mediaStates[kind+" "+trackCodec(track)]
+	s.mutex.Unlock()
+
+	if known && state.State != supervisor.StateStopped && sess.isOpen() {
+		sess.sendMessage("media_state", state, 0, "")
+	}
+
+	handler := s.mediaHandler(kind)
+	if handler == nil {
+		return
+	}
+
+	if err := handler.StartStreaming(track); err != nil {
+		fmt.Printf("Failed to start %s streaming for session %s: %v\n", kind, sess.id, err)
+	}
+}
+
+// releaseMedia removes the track from its media pipeline, which is stopped after the last session
+func (s *Server) releaseMedia(kind string, track webrtc.TrackLocal) {
+	if handler := s.mediaHandler(kind); handler != nil {
+		handler.StopStreaming(track)
+	}
+}
+
+// trackCodec returns the MIME type of the track
+func trackCodec(track webrtc.TrackLocal) string {
+	if codec, ok := track.(interface {
+		Codec() webrtc.RTPCodecCapability
+	}); ok {
+		return codec.Codec().MimeType
+	}
+	return ""
+}
+
+// reportMediaState pushes the state of the media pipeline of the codec to the sessions receiving it
+func (s *Server) reportMediaState(kind, codec string, status supervisor.Status) {
+	state := mediaState{
+		Kind:    kind,
+		Codec:   codec,
+		State:   status.State,
+		Reason:  status.Reason,
+		Attempt: status.Attempt,
+		RetryIn: status.RetryIn.Milliseconds(),
+	}
+
+	s.mutex.Lock()
+	s.mediaStates[kind+" "+codec] = state
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mutex.Unlock()
+
+	for _, sess := range sessions {
+		sess.mutex.Lock()
+		held := sess.mediaHeld[kind]
+		sess.mutex.Unlock()
+
+		if held != nil && trackCodec(held) == codec && sess.isOpen() {
+			sess.sendMessage("media_state", state, 0, "")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Typed messages are JSON envelopes on the data channel:
+//   {"v":1,"type":"drive","seq":7,"ts":1718000000000,"data":{...}}
+// A response carries the seq of its request in "replyTo" and either "data" or "error".
+// Handlers for message types are registered with Handle. Every other message (plain text like "COMBO 0 0.50 -0.20",
+// or envelopes of unregistered types) is passed through to the OnMessage callbacks unchanged.
+// Handlers run on the receive loop of the data channel, so messages of a session are handled in order.
+// A handler must not wait for a response of the same session (see Request), because that response is received by the same loop.
+
+package webrtcserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolVersion is the version of the message envelope
+const ProtocolVersion = 1
+
+// Message is the envelope of a typed data channel message
+type Message struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	Seq       uint64          `json:"seq"`
+	Timestamp int64           `json:"ts"`                // unix milliseconds of the sender
+	ReplyTo   uint64          `json:"replyTo,omitempty"` // seq of the request this message answers
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// messageHandler handles the decoded envelope of a registered type and returns the response data
+type messageHandler func(ctx context.Context, msg Message) (any, error)
+
+type sessionIDKey struct{}
+
+// SessionIDFromContext returns the id of the session a typed message was received from
+func SessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDKey{}).(string)
+	return sessionID
+}
+
+// messenger holds the typed message state of a session
+type messenger struct {
+	seq     atomic.Uint64
+	pending map[uint64]chan Message // open requests of the server keyed by their seq
+	mutex   sync.Mutex
+}
+
+func newMessenger() *messenger {
+	return &messenger{pending: make(map[uint64]chan Message)}
+}
+
+// Handle registers a handler for typed messages of the given type.
+// The data of the envelope is decoded into T. If the handler returns a non-nil value or an error, it is sent back as response.
+// Example: webrtcserver.Handle(server, "drive", func(ctx context.Context, cmd DriveCmd) (any, error) { ... })
+func Handle[T any](s *Server, msgType string, handler func(ctx context.Context, data T) (any, error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messageHandlers[msgType] = func(ctx context.Context, msg Message) (any, error) {
+		var data T
+		if len(msg.Data) > 0 {
+			if err := json.Unmarshal(msg.Data, &data); err != nil {
+				return nil, fmt.Errorf("invalid data for message type '%s': %w", msgType, err)
+			}
+		}
+		return handler(ctx, data)
+	}
+}
+
+// SendMessage broadcasts a typed message to all open sessions
+func (s *Server) SendMessage(msgType string, data any) error {
+	sessions := s.openSessions()
+	if len(sessions) == 0 {
+		return fmt.Errorf("data channel is not available")
+	}
+
+	var lastErr error
+	sent := 0
+	for _, sess := range sessions {
+		if err := sess.sendMessage(msgType, data, 0, ""); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// SendMessageTo sends a typed message to the session with the given id
+func (s *Server) SendMessageTo(sessionID, msgType string, data any) error {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	return sess.sendMessage(msgType, data, 0, "")
+}
+
+// Request sends a typed message to the session and waits for its response, which is decoded into response.
+func (s *Server) Request(ctx context.Context, sessionID, msgType string, data any, response any) error {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	// Register the request before sending, so a fast response is never missed
+	seq := sess.messenger.seq.Add(1)
+	replies := make(chan Message, 1)
+
+	sess.messenger.mutex.Lock()
+	sess.messenger.pending[seq] = replies
+	sess.messenger.mutex.Unlock()
+
+	defer func() {
+		sess.messenger.mutex.Lock()
+		delete(sess.messenger.pending, seq)
+		sess.messenger.mutex.Unlock()
+	}()
+
+	if err := sess.sendEnvelope(Message{Type: msgType, Seq: seq}, data); err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+		if response == nil || len(reply.Data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(reply.Data, response)
+	case <-sess.ctx.Done():
+		return fmt.Errorf("session %s closed", sessionID)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseMessage decodes a typed message. It returns false for everything, which is not an envelope of this protocol.
+func parseMessage(raw []byte) (Message, bool) {
+	if len(raw) == 0 || raw[0] != '{' {
+		return Message{}, false
+	}
+
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Version == 0 || msg.Type == "" {
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// handleTypedMessage dispatches a typed message of the session.
+// It returns false if the message is not handled and has to be passed through.
+func (s *Server) handleTypedMessage(sess *Session, msg Message) bool {
+	// Responses to requests of the server
+	if msg.ReplyTo != 0 {
+		sess.messenger.mutex.Lock()
+		replies, ok := sess.messenger.pending[msg.ReplyTo]
+		sess.messenger.mutex.Unlock()
+
+		if ok {
+			// A duplicate response must not block the receive loop, the buffer holds the first one
+			select {
+			case replies <- msg:
+			default:
+				fmt.Printf("Dropped duplicate response %d of session %s\n", msg.ReplyTo, sess.id)
+			}
+			return true
+		}
+	}
+
+	s.mutex.Lock()
+	handler, ok := s.messageHandlers[msg.Type]
+	s.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if msg.Version != ProtocolVersion {
+		sess.sendMessage(msg.Type, nil, msg.Seq, fmt.Sprintf("unsupported protocol version %d", msg.Version))
+		return true
+	}
+
+	if !s.control.allow(sess.id) {
+		sess.sendMessage(msg.Type, nil, msg.Seq, "session is not in control")
+		return true
+	}
+
+	ctx := context.WithValue(sess.ctx, sessionIDKey{}, sess.id)
+	response, err := handler(ctx, msg)
+	if err != nil {
+		sess.sendMessage(msg.Type, nil, msg.Seq, err.Error())
+		return true
+	}
+
+	if response != nil {
+		sess.sendMessage(msg.Type, response, msg.Seq, "")
+	}
+	return true
+}
+
+// sendMessage sends a typed message with the next seq of the session
+func (sess *Session) sendMessage(msgType string, data any, replyTo uint64, errorText string) error {
+	seq := sess.messenger.seq.Add(1)
+	return sess.sendEnvelope(Message{Type: msgType, Seq: seq, ReplyTo: replyTo, Error: errorText}, data)
+}
+
+// sendEnvelope completes the envelope with version, timestamp and data and sends it
+func (sess *Session) sendEnvelope(msg Message, data any) error {
+	msg.Version = ProtocolVersion
+	msg.Timestamp = time.Now().UnixMilli()
+
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode message data: %w", err)
+		}
+		msg.Data = encoded
+	}
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	return sess.sendText(string(encoded))
+}
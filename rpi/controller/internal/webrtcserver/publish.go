@@ -0,0 +1,192 @@
+// A client can publish its own camera (e.g. a phone as second viewpoint) with the video transceiver of its offer
+// (sendonly or sendrecv), also later with a renegotiation offer over WebSocket signaling.
+// The published video is forwarded without transcoding to the other sessions with WebSocket signaling.
+// They get it by renegotiation as additional track with the stream id "published-<session id>", also when they connect later.
+// Their keyframe requests are sent to the publisher.
+// While recording, the video is stored as published-<session id>-<codec> (e.g. published-<session id>-vp8.ivf), see recorder.go.
+// The forwarded tracks are removed from the viewers when the publisher stops sending or closes.
+
+package webrtcserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// publication is a video published by a client
+type publication struct {
+	key     string // stream id and track key of the forwarded tracks, "published-<session id>"
+	hub     *hub.Hub
+	viewers map[*Session]webrtc.TrackLocal
+	tap     hub.Tap // recording tap, nil if not recording
+}
+
+// receivePublished forwards and records the video published by the session until its track ends
+func (s *Server) receivePublished(sess *Session, remote *webrtc.TrackRemote) {
+	key := "published-" + sess.id
+	ssrc := uint32(remote.SSRC())
+
+	pub := &publication{
+		key:     key,
+		viewers: make(map[*Session]webrtc.TrackLocal),
+	}
+	pub.hub = hub.New(remote.Codec().RTPCodecCapability, "video", key, false, func() {
+		// Ask the publisher for a keyframe for its viewers
+		if err := sess.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+			fmt.Printf("Failed to request keyframe from session %s: %v\n", sess.id, err)
+		}
+	})
+
+	s.mutex.Lock()
+	s.publications[key] = pub
+	viewers := make([]*Session, 0, len(s.sessions))
+	for _, viewer := range s.sessions {
+		if viewer != sess {
+			viewers = append(viewers, viewer)
+		}
+	}
+	s.mutex.Unlock()
+
+	if rec := s.recorder.active(); rec != nil {
+		s.recordPublication(pub, rec)
+	}
+	for _, viewer := range viewers {
+		s.forwardPublication(pub, viewer)
+	}
+	fmt.Printf("Session %s publishes %s video\n", sess.id, remote.Codec().MimeType)
+
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := remote.Read(buffer)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				fmt.Printf("Published video of session %s ended: %v\n", sess.id, err)
+			}
+			break
+		}
+		pub.hub.Write(buffer[:n])
+	}
+
+	s.mutex.Lock()
+	delete(s.publications, key)
+	viewers = make([]*Session, 0, len(pub.viewers))
+	for viewer := range pub.viewers {
+		viewers = append(viewers, viewer)
+	}
+	s.mutex.Unlock()
+
+	s.recordPublication(pub, nil)
+	for _, viewer := range viewers {
+		if err := viewer.removeTrack(key); err != nil {
+			fmt.Printf("Failed to remove published video from session %s: %v\n", viewer.id, err)
+		}
+	}
+	fmt.Printf("Session %s stopped publishing video\n", sess.id)
+}
+
+// forwardPublication adds the published video to the viewer, if the viewer can be renegotiated
+func (s *Server) forwardPublication(pub *publication, viewer *Session) {
+	viewer.mutex.Lock()
+	renegotiable := viewer.signaling != nil && !viewer.closed
+	viewer.mutex.Unlock()
+	if !renegotiable {
+		return
+	}
+
+	track, err := pub.hub.NewTrack()
+	if err != nil {
+		fmt.Printf("Failed to forward published video to session %s: %v\n", viewer.id, err)
+		return
+	}
+
+	sender, err := viewer.addTrack(pub.key, track)
+	if err != nil || sender == nil {
+		fmt.Printf("Failed to forward published video to session %s: %v\n", viewer.id, err)
+		return
+	}
+
+	s.mutex.Lock()
+	pub.viewers[viewer] = track
+	s.mutex.Unlock()
+	pub.hub.Add(track)
+	pub.hub.RequestKeyframe()
+
+	// Keyframe requests of the viewer go to the publisher
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				switch packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					pub.hub.RequestKeyframe()
+				}
+			}
+		}
+	}()
+}
+
+// forwardPublications adds all published videos to a new viewer
+func (s *Server) forwardPublications(viewer *Session) {
+	s.mutex.Lock()
+	pubs := make([]*publication, 0, len(s.publications))
+	for key, pub := range s.publications {
+		if key != "published-"+viewer.id {
+			pubs = append(pubs, pub)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, pub := range pubs {
+		s.forwardPublication(pub, viewer)
+	}
+}
+
+// dropViewer stops forwarding the published videos to a closed session
+func (s *Server) dropViewer(viewer *Session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, pub := range s.publications {
+		if track, ok := pub.viewers[viewer]; ok {
+			pub.hub.Remove(track)
+			delete(pub.viewers, viewer)
+		}
+	}
+}
+
+// recordPublication passes the published video to a tap of the recording, a nil recording stops passing it
+func (s *Server) recordPublication(pub *publication, rec *recording) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if pub.tap != nil {
+		pub.hub.RemoveTap(pub.tap)
+		pub.tap = nil
+	}
+	if rec != nil {
+		pub.tap = rec.newTap(pub.key, pub.hub.Codec())
+		pub.hub.AddTap(pub.tap)
+	}
+}
+
+// recordPublications passes all published videos to taps of the recording, a nil recording stops passing them
+func (s *Server) recordPublications(rec *recording) {
+	s.mutex.Lock()
+	pubs := make([]*publication, 0, len(s.publications))
+	for _, pub := range s.publications {
+		pubs = append(pubs, pub)
+	}
+	s.mutex.Unlock()
+
+	for _, pub := range pubs {
+		s.recordPublication(pub, rec)
+	}
+}
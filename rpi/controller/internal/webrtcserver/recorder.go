@@ -0,0 +1,559 @@
+// Recordings keep what the operator saw and sent for debugging after a run. Each recording is a directory named after its
+// start time (e.g. 20261017-120000.123) in the recording directory (RECORD_DIR, default "recordings"), which contains
+//   video-vp8.ivf, video-vp9.ivf, video-av1.ivf or video-h264.h264 for every video pipeline that ran, audio-opus.ogg
+//   published-<session id>-vp8.ivf for every video published by a client, see publish.go
+//   messages.jsonl with every data channel and serial message, one JSON object per line, e.g.
+//   {"time":"2026-10-17T12:00:00.123Z","source":"datachannel","direction":"in","session":"4f2a...","channel":"data","data":"COMBO 10 0 0"}
+// Binary messages are stored base64 encoded with "binary":true. The pipelines are only tapped, they keep running for viewers only,
+// so a video file starts with the next keyframe. The oldest recordings are deleted when the directory grows beyond RECORD_MAX_MB (default 1024).
+// A recording running longer than RECORD_MAX_MINUTES (default 60) or growing beyond a quarter of RECORD_MAX_MB is continued
+// in a new one, so the retention can delete its older parts.
+
+package webrtcserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/hub"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+const (
+	defaultRecordDir        = "recordings"
+	defaultRecordMaxMB      = 1024
+	defaultRecordMaxMinutes = 60
+	recordingShare          = 4           // a recording is continued in a new one when it passes this part of the size limit
+	retentionInterval       = time.Minute // the retention limit and the limits of the current recording are also checked while recording
+	recordingNameLayout     = "20060102-150405.000"
+	maxNameAttempts         = 100 // suffixes tried when a recording of the same millisecond exists
+)
+
+// RecordingState describes the current recording
+type RecordingState struct {
+	Recording bool      `json:"recording"`
+	Name      string    `json:"name,omitempty"`
+	Directory string    `json:"directory,omitempty"`
+	StartedAt time.Time `json:"startedAt,omitzero"`
+}
+
+// recorder starts and stops recordings in the recording directory
+type recorder struct {
+	dir         string
+	maxSize     int64         // bytes of all recordings
+	maxAge      time.Duration // duration of a recording before it is continued in a new one
+	current     *recording
+	mutex       sync.Mutex
+	switchMutex sync.Mutex // serializes starting, stopping and continuing recordings
+}
+
+// recording is a running recording
+type recording struct {
+	name      string
+	dir       string
+	startedAt time.Time
+	log       *os.File
+	logMutex  sync.Mutex
+	taps      []*trackTap
+	tapsMutex sync.Mutex
+	stopChan  chan struct{}
+}
+
+// recordedMessage is a line of messages.jsonl
+type recordedMessage struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`    // datachannel or serial
+	Direction string    `json:"direction"` // in (to the controller) or out
+	Session   string    `json:"session,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Binary    bool      `json:"binary,omitempty"`
+	Data      string    `json:"data"`
+}
+
+// trackTap writes the stream of a media pipeline to a file, the file is created with the first packet
+type trackTap struct {
+	path   string
+	codec  webrtc.RTPCodecCapability
+	writer interface {
+		WriteRTP(packet *rtp.Packet) error
+		Close() error
+	}
+	packetizer rtp.Packetizer // packetizes the samples of sample pipelines for the writer
+	failed     bool
+	closed     bool
+	mutex      sync.Mutex
+}
+
+// newRecorder configures the recorder with RECORD_DIR, RECORD_MAX_MB and RECORD_MAX_MINUTES
+func newRecorder() (*recorder, error) {
+	dir := os.Getenv("RECORD_DIR")
+	if dir == "" {
+		dir = defaultRecordDir
+	}
+
+	maxMB := defaultRecordMaxMB
+	if value := os.Getenv("RECORD_MAX_MB"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid RECORD_MAX_MB %q", value)
+		}
+		maxMB = parsed
+	}
+
+	maxMinutes := defaultRecordMaxMinutes
+	if value := os.Getenv("RECORD_MAX_MINUTES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid RECORD_MAX_MINUTES %q", value)
+		}
+		maxMinutes = parsed
+	}
+
+	return &recorder{dir: dir, maxSize: int64(maxMB) << 20, maxAge: time.Duration(maxMinutes) * time.Minute}, nil
+}
+
+// StartRecording starts recording the media pipelines and all messages
+func (s *Server) StartRecording() (RecordingState, error) {
+	s.recorder.switchMutex.Lock()
+	defer s.recorder.switchMutex.Unlock()
+
+	return s.startRecording()
+}
+
+// StopRecording stops the current recording and applies the retention limit
+func (s *Server) StopRecording() (RecordingState, error) {
+	s.recorder.switchMutex.Lock()
+	defer s.recorder.switchMutex.Unlock()
+
+	return s.stopRecording()
+}
+
+// continueRecording stops the recording, which passed its size or age limit, and starts a new one
+func (s *Server) continueRecording(rec *recording) {
+	s.recorder.switchMutex.Lock()
+	defer s.recorder.switchMutex.Unlock()
+
+	// The recording may have been stopped in the meantime
+	if s.recorder.active() != rec {
+		return
+	}
+
+	fmt.Printf("Recording %s reached its limit, continuing in a new recording\n", rec.dir)
+	if _, err := s.stopRecording(); err != nil {
+		fmt.Printf("Failed to stop recording %s: %v\n", rec.dir, err)
+	}
+	if _, err := s.startRecording(); err != nil {
+		fmt.Printf("Failed to continue recording: %v\n", err)
+	}
+}
+
+func (s *Server) startRecording() (RecordingState, error) {
+	rec, err := s.recorder.start(s.continueRecording)
+	if err != nil {
+		return RecordingState{}, err
+	}
+
+	for _, kind := range mediaKinds {
+		if handler := s.mediaHandler(kind); handler != nil {
+			handler.Record(func(codec webrtc.RTPCodecCapability) hub.Tap {
+				return rec.newTap(kind, codec)
+			})
+		}
+	}
+	s.recordPublications(rec)
+
+	fmt.Printf("Started recording %s\n", rec.dir)
+	return s.RecordingState(), nil
+}
+
+func (s *Server) stopRecording() (RecordingState, error) {
+	for _, kind := range mediaKinds {
+		if handler := s.mediaHandler(kind); handler != nil {
+			handler.Record(nil)
+		}
+	}
+	s.recordPublications(nil)
+
+	state := s.RecordingState()
+	if err := s.recorder.stop(); err != nil {
+		return RecordingState{}, err
+	}
+
+	fmt.Printf("Stopped recording %s\n", state.Directory)
+	state.Recording = false
+	return state, nil
+}
+
+// RecordingState returns the state of the current recording
+func (s *Server) RecordingState() RecordingState {
+	s.recorder.mutex.Lock()
+	defer s.recorder.mutex.Unlock()
+
+	rec := s.recorder.current
+	if rec == nil {
+		return RecordingState{}
+	}
+	return RecordingState{Recording: true, Name: rec.name, Directory: rec.dir, StartedAt: rec.startedAt}
+}
+
+// RecordSerial adds a message of the serial port to the current recording, direction is "in" for messages from the
+// microcontroller and "out" for messages to it
+func (s *Server) RecordSerial(direction string, data []byte, binary bool) {
+	s.recorder.message("serial", direction, "", "", data, binary)
+}
+
+// handleRecording returns the recording state on GET, starts a recording on POST and stops it on DELETE
+func (s *Server) handleRecording(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var state RecordingState
+	var err error
+	switch r.Method {
+	case "GET":
+		state = s.RecordingState()
+	case "POST":
+		state, err = s.StartRecording()
+	case "DELETE":
+		state, err = s.StopRecording()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// start creates the directory of a new recording and its message log.
+// onLimit is called when the recording passes its size or age limit.
+func (r *recorder) start(onLimit func(rec *recording)) (*recording, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.current != nil {
+		return nil, errors.New("recording already in progress")
+	}
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	r.applyRetention("")
+
+	now := time.Now()
+	name, dir, err := r.create(now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	log, err := os.Create(filepath.Join(dir, "messages.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message log: %w", err)
+	}
+
+	rec := &recording{name: name, dir: dir, startedAt: now, log: log, stopChan: make(chan struct{})}
+	r.current = rec
+
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rec.stopChan:
+				return
+			case <-ticker.C:
+				r.applyRetention(rec.name)
+				if r.exceeded(rec) {
+					onLimit(rec)
+				}
+			}
+		}
+	}()
+	return rec, nil
+}
+
+// create creates the directory of a recording started at the given time. A recording of the same millisecond
+// gets a counter appended to its name, so the names are unique and still sort by start time.
+func (r *recorder) create(startedAt time.Time) (name, dir string, err error) {
+	base := startedAt.Format(recordingNameLayout)
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		name = base
+		if attempt > 0 {
+			name = fmt.Sprintf("%s-%d", base, attempt)
+		}
+		dir = filepath.Join(r.dir, name)
+
+		err = os.Mkdir(dir, 0o755)
+		if !errors.Is(err, fs.ErrExist) {
+			return name, dir, err
+		}
+	}
+	return "", "", err
+}
+
+// exceeded reports whether the recording passed its age or size limit
+func (r *recorder) exceeded(rec *recording) bool {
+	return time.Since(rec.startedAt) >= r.maxAge || directorySize(rec.dir) >= r.maxSize/recordingShare
+}
+
+// stop closes the files of the current recording
+func (r *recorder) stop() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rec := r.current
+	if rec == nil {
+		return errors.New("no recording in progress")
+	}
+	r.current = nil
+	close(rec.stopChan)
+
+	var errs []error
+	rec.tapsMutex.Lock()
+	for _, tap := range rec.taps {
+		errs = append(errs, tap.close())
+	}
+	rec.tapsMutex.Unlock()
+
+	rec.logMutex.Lock()
+	errs = append(errs, rec.log.Close())
+	rec.logMutex.Unlock()
+
+	r.applyRetention(rec.name)
+	return errors.Join(errs...)
+}
+
+// active returns the current recording or nil
+func (r *recorder) active() *recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// message appends a data channel or serial message to the log of the current recording
+func (r *recorder) message(source, direction, sessionID, channel string, data []byte, binary bool) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	rec := r.current
+	r.mutex.Unlock()
+	if rec == nil {
+		return
+	}
+
+	entry := recordedMessage{
+		Time:      time.Now().UTC(),
+		Source:    source,
+		Direction: direction,
+		Session:   sessionID,
+		Channel:   channel,
+		Binary:    binary,
+		Data:      string(data),
+	}
+	if binary {
+		entry.Data = base64.StdEncoding.EncodeToString(data)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	rec.logMutex.Lock()
+	defer rec.logMutex.Unlock()
+	if _, err := rec.log.Write(append(line, '\n')); err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Printf("Failed to record message: %v\n", err)
+	}
+}
+
+// applyRetention deletes the oldest recordings except the one named keep until the directory fits the size limit.
+// It only reads the settings of the recorder, so it does not need its lock.
+func (r *recorder) applyRetention(keep string) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+
+	type recordingSize struct {
+		name string
+		size int64
+	}
+	var recordings []recordingSize
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		size := directorySize(filepath.Join(r.dir, entry.Name()))
+		recordings = append(recordings, recordingSize{entry.Name(), size})
+		total += size
+	}
+
+	// The names are start times, so they sort from the oldest to the newest
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].name < recordings[j].name })
+
+	for _, old := range recordings {
+		if total <= r.maxSize {
+			return
+		}
+		if old.name == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(r.dir, old.name)); err != nil {
+			fmt.Printf("Failed to delete recording %s: %v\n", old.name, err)
+			continue
+		}
+		fmt.Printf("Deleted recording %s (retention limit %d MB)\n", old.name, r.maxSize>>20)
+		total -= old.size
+	}
+}
+
+// directorySize returns the size of all files in the directory
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// newTap creates the tap of a media stream named prefix-codec, e.g. video-vp8.ivf for the VP8 pipeline
+func (rec *recording) newTap(prefix string, codec webrtc.RTPCodecCapability) hub.Tap {
+	_, name, _ := strings.Cut(strings.ToLower(codec.MimeType), "/")
+
+	extension := "ivf"
+	switch name {
+	case "h264":
+		extension = "h264"
+	case "opus":
+		extension = "ogg"
+	}
+
+	tap := &trackTap{
+		path:  filepath.Join(rec.dir, fmt.Sprintf("%s-%s.%s", prefix, name, extension)),
+		codec: codec,
+	}
+
+	rec.tapsMutex.Lock()
+	rec.taps = append(rec.taps, tap)
+	rec.tapsMutex.Unlock()
+	return tap
+}
+
+// WriteRTP writes an RTP packet of the pipeline to the file
+func (t *trackTap) WriteRTP(packet *rtp.Packet) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.write(packet)
+}
+
+// WriteSample packetizes a frame of a sample pipeline (H.264 pass-through, synthetic sources) and writes it to the file,
+// so the writer frames it like the RTP of the other pipelines
+func (t *trackTap) WriteSample(sample media.Sample) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.packetizer == nil {
+		payloader, err := payloaderFor(t.codec)
+		if err != nil {
+			if !t.failed {
+				fmt.Printf("Failed to record %s: %v\n", t.path, err)
+				t.failed = true
+			}
+			return err
+		}
+		t.packetizer = rtp.NewPacketizer(1200, 0, 0, payloader, rtp.NewRandomSequencer(), t.codec.ClockRate)
+	}
+
+	samples := uint32(sample.Duration.Seconds() * float64(t.codec.ClockRate))
+	for _, packet := range t.packetizer.Packetize(sample.Data, samples) {
+		if err := t.write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes an RTP packet to the file, which is created with the first packet
+func (t *trackTap) write(packet *rtp.Packet) error {
+	if t.closed || t.failed {
+		return nil
+	}
+
+	if t.writer == nil {
+		var err error
+		switch strings.ToLower(t.codec.MimeType) {
+		case strings.ToLower(webrtc.MimeTypeH264):
+			t.writer, err = h264writer.New(t.path)
+		case strings.ToLower(webrtc.MimeTypeOpus):
+			t.writer, err = oggwriter.New(t.path, 48000, 2)
+		default:
+			t.writer, err = ivfwriter.New(t.path, ivfwriter.WithCodec(t.codec.MimeType))
+		}
+		if err != nil {
+			fmt.Printf("Failed to create recording file %s: %v\n", t.path, err)
+			t.failed = true
+			return err
+		}
+	}
+
+	return t.writer.WriteRTP(packet)
+}
+
+// payloaderFor returns the RTP payloader of the codec
+func payloaderFor(codec webrtc.RTPCodecCapability) (rtp.Payloader, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}, nil
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &codecs.VP8Payloader{}, nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return &codecs.VP9Payloader{}, nil
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return &codecs.AV1Payloader{}, nil
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return &codecs.OpusPayloader{}, nil
+	default:
+		return nil, fmt.Errorf("no payloader for %s", codec.MimeType)
+	}
+}
+
+// close closes the file of the tap
+func (t *trackTap) close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	if t.writer != nil {
+		return t.writer.Close()
+	}
+	return nil
+}
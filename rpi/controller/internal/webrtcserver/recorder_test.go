@@ -0,0 +1,62 @@
+package webrtcserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecordingNames checks that recordings started within the same millisecond get unique names, which sort by start time
+func TestRecordingNames(t *testing.T) {
+	r := &recorder{dir: t.TempDir(), maxSize: 1 << 20, maxAge: time.Hour}
+
+	startedAt := time.Date(2026, 10, 17, 12, 0, 0, 123e6, time.Local)
+	first, _, err := r.create(startedAt)
+	if err != nil {
+		t.Fatalf("failed to create the first recording: %v", err)
+	}
+	second, _, err := r.create(startedAt)
+	if err != nil {
+		t.Fatalf("failed to create the second recording: %v", err)
+	}
+	if first != "20261017-120000.123" || second != "20261017-120000.123-1" {
+		t.Errorf("recordings are named %s and %s", first, second)
+	}
+
+	// Stopping and starting again right away
+	for i := 0; i < 3; i++ {
+		if _, err := r.start(func(*recording) {}); err != nil {
+			t.Fatalf("failed to start recording %d: %v", i, err)
+		}
+		if err := r.stop(); err != nil {
+			t.Fatalf("failed to stop recording %d: %v", i, err)
+		}
+	}
+}
+
+// TestRecordingLimits checks that the current recording passes its limit with its age or a quarter of the size limit
+func TestRecordingLimits(t *testing.T) {
+	r := &recorder{dir: t.TempDir(), maxSize: 4 << 10, maxAge: time.Hour}
+	rec, err := r.start(func(*recording) {})
+	if err != nil {
+		t.Fatalf("failed to start recording: %v", err)
+	}
+	defer r.stop()
+
+	if r.exceeded(rec) {
+		t.Fatal("new recording exceeded its limit")
+	}
+
+	if err := os.WriteFile(filepath.Join(rec.dir, "video-vp8.ivf"), make([]byte, 1<<10), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if !r.exceeded(rec) {
+		t.Error("recording of a quarter of the size limit did not exceed it")
+	}
+
+	old := &recording{dir: t.TempDir(), startedAt: time.Now().Add(-time.Hour)}
+	if !r.exceeded(old) {
+		t.Error("recording of the maximum age did not exceed it")
+	}
+}
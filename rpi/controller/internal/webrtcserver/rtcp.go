@@ -0,0 +1,71 @@
+// The RTCP of every media sender is read, otherwise the interceptors (NACK responder, TWCC) never see the feedback of the client.
+// Picture loss indications and full intra requests are forwarded to the encoder of the track as keyframe request.
+// NACKed packets are retransmitted by the NACK responder. A burst of NACKs means the loss is too high for retransmissions
+// to catch up, the reader then requests a keyframe as well. The encoder rate limits the keyframes it forces.
+
+package webrtcserver
+
+import (
+	"time"
+
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	nackBurstWindow  = time.Second
+	nackBurstPackets = 50 // NACKed packets within the window which trigger a keyframe request
+)
+
+var feedbackMetric = metrics.NewCounterVec("controller_rtcp_feedback_total", "RTCP feedback packets received from the clients by type (pli, fir, nack).", "type")
+
+// readRTCP reads the RTCP of the sender until it is removed or its peer connection is closed
+func (s *Server) readRTCP(kind string, sender *webrtc.RTPSender) {
+	nacked := 0
+	windowStart := time.Now()
+
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		keyframe := false
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication:
+				feedbackMetric.With("pli").Inc()
+				keyframe = true
+			case *rtcp.FullIntraRequest:
+				feedbackMetric.With("fir").Inc()
+				keyframe = true
+			case *rtcp.TransportLayerNack:
+				feedbackMetric.With("nack").Inc()
+
+				if time.Since(windowStart) > nackBurstWindow {
+					nacked = 0
+					windowStart = time.Now()
+				}
+				for _, pair := range packet.Nacks {
+					nacked += len(pair.PacketList())
+				}
+				if nacked >= nackBurstPackets {
+					nacked = 0
+					keyframe = true
+				}
+			}
+		}
+
+		if !keyframe {
+			continue
+		}
+
+		// The sender may have been switched off with ReplaceTrack(nil)
+		track := sender.Track()
+		handler := s.mediaHandler(kind)
+		if track != nil && handler != nil {
+			handler.RequestKeyframe(track)
+		}
+	}
+}
@@ -5,18 +5,42 @@
 package webrtcserver
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/metrics"
 	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/audio"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/speaker"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/supervisor"
 	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver/internal/video"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	stateTransitionsMetric = metrics.NewCounterVec("controller_peer_state_transitions_total", "Peer connection state changes of all sessions.", "state")
+	messagesMetric         = metrics.NewCounterVec("controller_datachannel_messages_total", "Data channel messages of all sessions.", "direction")
+	messageBytesMetric     = metrics.NewCounterVec("controller_datachannel_bytes_total", "Data channel payload bytes of all sessions.", "direction")
+)
+
+// The session gauges are registered once per process and count the sessions of all servers, which are not closed
+var (
+	gaugeServers      = make(map[*Server]struct{})
+	gaugeServersMutex sync.Mutex
+	registerGauges    sync.Once
 )
 
 //go:embed public
@@ -24,52 +48,140 @@ var embedFS embed.FS // embed all static files into the binary
 
 // Server represents the WebRTC server
 type Server struct {
-	peerConnection   *webrtc.PeerConnection
-	dataChannel      *webrtc.DataChannel
-	api              *webrtc.API
-	mutex            sync.Mutex
-	stopChan         chan bool
-	messageCallbacks []func(string)
-	port             string
-	videoHandler     *video.Handler
-	videoEnabled     bool
-	audioHandler     *audio.Handler
-	audioEnabled     bool
+	sessions            map[string]*Session
+	api                 *webrtc.API
+	peerConnectionMutex sync.Mutex            // serializes NewPeerConnection to hand over the stats getter and estimator
+	pendingStatsGetter  stats.Getter          // stats getter of the peer connection being created, see stats.go
+	pendingEstimator    cc.BandwidthEstimator // bandwidth estimator of the peer connection being created, see bitrate.go
+	mutex               sync.Mutex
+	messageCallbacks    []func(sessionID, message string)
+	binaryCallbacks     []func(sessionID string, data []byte)
+	stateCallbacks      []func(sessionID, state string)
+	activityCallbacks   []func(sessionID string)
+	channels            map[string]*Channel       // named data channels keyed by label, see channels.go
+	messageHandlers     map[string]messageHandler // handlers of typed messages keyed by type, see protocol.go
+	mediaStates         map[string]mediaState     // latest state of the media pipelines keyed by kind and codec, see media.go
+	recorder            *recorder                 // see recorder.go
+	publications        map[string]*publication   // videos published by clients keyed by stream id, see publish.go
+	control             *controlArbiter
+	httpServer          *http.Server
+	stopChan            chan struct{} // closed by Close to stop the background loops
+	videoHandler        *video.Handler
+	videoEnabled        bool
+	audioHandler        *audio.Handler
+	audioEnabled        bool
+	speakerHandler      *speaker.Handler // plays the microphone of the talking session, see talk.go
+	talker              string           // id of the session holding push-to-talk
 }
 
 // SDPRequest represents an incoming SDP offer
 type SDPRequest struct {
-	Type string `json:"type"`
-	SDP  string `json:"sdp"`
+	Type    string `json:"type"`
+	SDP     string `json:"sdp"`
+	Trickle bool   `json:"trickle,omitempty"` // answer without waiting for ICE gathering, see trickle.go
 }
 
 // SDPResponse represents an SDP answer response
 type SDPResponse struct {
-	Type  string `json:"type"`
-	SDP   string `json:"sdp"`
-	Error string `json:"error,omitempty"`
+	Type      string `json:"type"`
+	SDP       string `json:"sdp"`
+	SessionID string `json:"sessionId,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
-// New creates a new WebRTC server instance and starts it
+// New creates a new WebRTC server instance and starts it on the port of all interfaces
 func New(port string, videoEnabled, audioEnabled bool) *Server {
+	server := newServer(videoEnabled, audioEnabled)
+	server.httpServer.Addr = ":" + port
+
+	// Start the server in a goroutine
+	go func() {
+		fmt.Printf("WebRTC Server starting on port %s\n", port)
+		if err := server.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Server error: %v\n", err)
+		}
+	}()
+
+	return server
+}
+
+// NewWithListener creates a new WebRTC server instance and serves it on the listener, e.g. of a free port in tests
+func NewWithListener(listener net.Listener, videoEnabled, audioEnabled bool) *Server {
+	server := newServer(videoEnabled, audioEnabled)
+
+	go func() {
+		fmt.Printf("WebRTC Server starting on %s\n", listener.Addr())
+		if err := server.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Server error: %v\n", err)
+		}
+	}()
+
+	return server
+}
+
+// newServer creates a server with its media handlers and routes, the caller starts serving them
+func newServer(videoEnabled, audioEnabled bool) *Server {
 	server := &Server{
-		port:         port,
-		videoEnabled: videoEnabled,
-		audioEnabled: audioEnabled,
+		sessions:        make(map[string]*Session),
+		mediaStates:     make(map[string]mediaState),
+		publications:    make(map[string]*publication),
+		channels:        make(map[string]*Channel),
+		messageHandlers: make(map[string]messageHandler),
+		videoEnabled:    videoEnabled,
+		audioEnabled:    audioEnabled,
+		stopChan:        make(chan struct{}),
 	}
 
+	server.control = newControlArbiter(func(sessionID, message string) {
+		if err := server.SendDataTo(sessionID, message); err != nil {
+			fmt.Printf("Failed to send control message to session %s: %v\n", sessionID, err)
+		}
+	}, func(sessionID string) bool {
+		return server.session(sessionID) != nil
+	})
+
 	server.setupWebRTC()
 
+	recorder, err := newRecorder()
+	if err != nil {
+		log.Fatalf("failed to configure recorder: %v", err)
+	}
+	server.recorder = recorder
+
 	// Initialize video handler only if video is enabled
 	if server.videoEnabled {
 		server.videoHandler = video.NewHandler()
+		go server.adaptVideo()
 	}
 
 	// Initialize audio handler only if audio is enabled
 	if server.audioEnabled {
 		server.audioHandler = audio.NewHandler()
+		server.speakerHandler = speaker.NewHandler()
+	}
+
+	// Push the state of the media pipelines to the sessions, see media.go
+	for _, kind := range mediaKinds {
+		if handler := server.mediaHandler(kind); handler != nil {
+			handler.OnState(func(codec string, status supervisor.Status) {
+				server.reportMediaState(kind, codec, status)
+			})
+		}
 	}
 
+	gaugeServersMutex.Lock()
+	gaugeServers[server] = struct{}{}
+	gaugeServersMutex.Unlock()
+
+	registerGauges.Do(func() {
+		metrics.NewGaugeFunc("controller_sessions", "Number of sessions.", sessionGauge(func(s *Server) int {
+			return len(s.Sessions())
+		}))
+		metrics.NewGaugeFunc("controller_sessions_open", "Number of sessions with an open data channel.", sessionGauge(func(s *Server) int {
+			return len(s.openSessions())
+		}))
+	})
+
 	mux := http.NewServeMux()
 
 	// Serve static files from embedded `public` directory
@@ -86,49 +198,192 @@ func New(port string, videoEnabled, audioEnabled bool) *Server {
 
 	// API routes
 	mux.HandleFunc("/api/offer", server.handleOffer)
+	mux.HandleFunc("/api/sessions", server.handleSessions)
+	mux.HandleFunc("/api/sessions/{id}/candidates", server.handleCandidates)
+	mux.HandleFunc("/api/control", server.handleControl)
+	mux.HandleFunc("/api/stats", server.handleStats)
+	mux.HandleFunc("/api/recording", server.handleRecording)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/api/ws", websocket.Server{Handler: server.handleWebSocket}) // accept any origin, like the CORS headers of the other routes
+
+	// WHEP routes, see whep.go
+	mux.HandleFunc("/whep", server.handleWHEP)
+	mux.HandleFunc("/whep/{id}", server.handleWHEPResource)
+
+	server.httpServer = &http.Server{Handler: mux}
+	return server
+}
 
-	// Start the server in a goroutine
-	go func() {
-		fmt.Printf("WebRTC Server starting on port %s\n", server.port)
-		if err := http.ListenAndServe(":"+server.port, mux); err != nil {
-			fmt.Printf("Server error: %v\n", err)
+// Close stops serving HTTP and closes all sessions, which stops their media pipelines
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	select {
+	case <-s.stopChan:
+		s.mutex.Unlock()
+		return nil
+	default:
+	}
+	close(s.stopChan)
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mutex.Unlock()
+
+	gaugeServersMutex.Lock()
+	delete(gaugeServers, s)
+	gaugeServersMutex.Unlock()
+
+	err := s.httpServer.Close()
+	for _, sess := range sessions {
+		s.closeSession(sess)
+	}
+	return err
+}
+
+// sessionGauge returns the value function of a session gauge, which sums count over all servers that are not closed
+func sessionGauge(count func(s *Server) int) func() float64 {
+	return func() float64 {
+		gaugeServersMutex.Lock()
+		servers := make([]*Server, 0, len(gaugeServers))
+		for server := range gaugeServers {
+			servers = append(servers, server)
 		}
-	}()
+		gaugeServersMutex.Unlock()
 
-	return server
+		total := 0
+		for _, server := range servers {
+			total += count(server)
+		}
+		return float64(total)
+	}
 }
 
-// SendData sends data through the WebRTC data channel if it exists
+// SendData broadcasts data through the data channels of all open sessions.
+// An error is returned if no session received the data.
 func (s *Server) SendData(data string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if s.dataChannel == nil {
+	sessions := s.openSessions()
+	if len(sessions) == 0 {
 		return fmt.Errorf("data channel is not available")
 	}
 
-	if s.dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
-		return fmt.Errorf("data channel is not open")
+	var lastErr error
+	sent := 0
+	for _, sess := range sessions {
+		if err := sess.sendText(data); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// SendDataTo sends data through the data channel of the session with the given id
+func (s *Server) SendDataTo(sessionID, data string) error {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	return s.dataChannel.SendText(data)
+	return sess.sendText(data)
 }
 
 // OnMessage registers a callback function that will be executed when a new message is received.
+// Only messages of the session in control are delivered, see control.go.
+// The callback receives the id of the session the message originates from.
 // Multiple callbacks can be registered; they are appended to the internal list.
-func (s *Server) OnMessage(callback func(string)) {
+func (s *Server) OnMessage(callback func(sessionID, message string)) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	s.messageCallbacks = append(s.messageCallbacks, callback)
 }
 
-// IsConnected returns true if the data channel is connected and ready
-func (s *Server) IsConnected() bool {
+// SendBinary broadcasts binary data through the data channels of all open sessions.
+// An error is returned if no session received the data.
+func (s *Server) SendBinary(data []byte) error {
+	sessions := s.openSessions()
+	if len(sessions) == 0 {
+		return fmt.Errorf("data channel is not available")
+	}
+
+	var lastErr error
+	sent := 0
+	for _, sess := range sessions {
+		if err := sess.sendBinary(data); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// SendBinaryTo sends binary data through the data channel of the session with the given id
+func (s *Server) SendBinaryTo(sessionID string, data []byte) error {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return fmt.Errorf("session %s not found", sessionID)
+	}
+
+	return sess.sendBinary(data)
+}
+
+// OnBinaryMessage registers a callback function that will be executed when a new binary message is received.
+// Like OnMessage, only messages of the session in control are delivered.
+func (s *Server) OnBinaryMessage(callback func(sessionID string, data []byte)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.binaryCallbacks = append(s.binaryCallbacks, callback)
+}
+
+// OnActivity registers a callback function that will be executed after every message of the session in control,
+// whatever channel and kind (text, binary, typed, control or media message) it has, e.g. to feed a watchdog.
+func (s *Server) OnActivity(callback func(sessionID string)) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	return s.dataChannel != nil && s.dataChannel.ReadyState() == webrtc.DataChannelStateOpen
+	s.activityCallbacks = append(s.activityCallbacks, callback)
+}
+
+// OnSessionState registers a callback function that will be executed when the connection state of a session changes.
+// The state is one of "connecting", "connected", "disconnected", "failed" and "closed".
+func (s *Server) OnSessionState(callback func(sessionID, state string)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stateCallbacks = append(s.stateCallbacks, callback)
+}
+
+// IsConnected returns true if at least one session has a connected and ready data channel
+func (s *Server) IsConnected() bool {
+	return len(s.openSessions()) > 0
+}
+
+// Sessions returns a snapshot of all current sessions
+func (s *Server) Sessions() []SessionInfo {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mutex.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.info())
+	}
+	return infos
 }
 
 func (s *Server) setupWebRTC() {
@@ -138,42 +393,96 @@ func (s *Server) setupWebRTC() {
 	// Enable ICE Lite mode for better performance on server/device side
 	settingEngine.SetLite(true)
 
-	s.api = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
-}
+	// Register the default codecs and interceptors plus the stats interceptor for the stats collector
+	// and the congestion controller for the adaptive video bitrate
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		log.Fatalf("failed to register default codecs: %v", err)
+	}
 
-func (s *Server) closeExistingConnections() {
-	// Stop video streaming if it's running
-	if s.videoEnabled && s.videoHandler != nil {
-		s.videoHandler.StopStreaming()
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		log.Fatalf("failed to register default interceptors: %v", err)
 	}
 
-	// Stop audio streaming if it's running
-	if s.audioEnabled && s.audioHandler != nil {
-		s.audioHandler.StopStreaming()
+	statsInterceptor, err := s.newStatsInterceptor()
+	if err != nil {
+		log.Fatalf("failed to create stats interceptor: %v", err)
 	}
+	interceptorRegistry.Add(statsInterceptor)
 
-	// Stop any existing channels
-	if s.stopChan != nil {
-		close(s.stopChan)
-		s.stopChan = nil
+	bandwidthEstimator, err := s.newBandwidthEstimator()
+	if err != nil {
+		log.Fatalf("failed to create bandwidth estimator: %v", err)
 	}
+	interceptorRegistry.Add(bandwidthEstimator)
 
-	// Close existing data channel
-	if s.dataChannel != nil {
-		fmt.Println("Closing existing data channel")
-		if err := s.dataChannel.Close(); err != nil {
-			fmt.Printf("Error closing data channel: %v\n", err)
-		}
-		s.dataChannel = nil
+	// The client sends transport wide CC feedback for the sequence numbers of this header extension.
+	// It is registered after the bandwidth estimator, so the sequence number is set before the estimator sees the packet.
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		log.Fatalf("failed to register transport wide CC header extension: %v", err)
 	}
 
-	// Close existing peer connection
-	if s.peerConnection != nil {
-		fmt.Println("Closing existing peer connection")
-		if err := s.peerConnection.Close(); err != nil {
-			fmt.Printf("Error closing peer connection: %v\n", err)
+	s.api = webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	)
+}
+
+// session returns the session with the given id or nil
+func (s *Server) session(sessionID string) *Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sessions[sessionID]
+}
+
+// openSessions returns all sessions with an open data channel
+func (s *Server) openSessions() []*Session {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mutex.Unlock()
+
+	open := sessions[:0]
+	for _, sess := range sessions {
+		if sess.isOpen() {
+			open = append(open, sess)
 		}
-		s.peerConnection = nil
+	}
+	return open
+}
+
+// closeSession releases the media pipelines of the session, closes its peer connection and removes it from the server.
+// It is safe to call closeSession multiple times.
+func (s *Server) closeSession(sess *Session) {
+	sess.mutex.Lock()
+	if sess.closed {
+		sess.mutex.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.cancel()
+	sess.mutex.Unlock()
+
+	s.syncMedia(sess)
+
+	s.mutex.Lock()
+	delete(s.sessions, sess.id)
+	last := len(s.sessions) == 0
+	s.mutex.Unlock()
+
+	s.control.remove(sess.id, last)
+	s.releaseTalk(sess.id)
+	s.dropViewer(sess)
+
+	// Close peer connection (this also closes the data channel)
+	fmt.Printf("Closing peer connection of session %s\n", sess.id)
+	if err := sess.peerConnection.Close(); err != nil {
+		fmt.Printf("Error closing peer connection: %v\n", err)
 	}
 }
 
@@ -198,138 +507,147 @@ func (s *Server) handleOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer, err := s.processOffer(req.Type, req.SDP)
+	sess, answer, err := s.processOffer(req.Type, req.SDP, req.Trickle)
 	if err != nil {
 		s.sendError(w, "Error processing offer: "+err.Error())
 		return
 	}
 
-	response := SDPResponse{Type: "answer", SDP: answer}
+	response := SDPResponse{Type: "answer", SDP: answer, SessionID: sess.id}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) processOffer(offerType, offerSDP string) (string, error) {
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Sessions())
+}
+
+// processOffer creates a new session for the offer and returns its answer.
+// Without trickle the answer contains all ICE candidates, with trickle it is returned immediately.
+func (s *Server) processOffer(offerType, offerSDP string, trickle bool) (*Session, string, error) {
 	// Validate offer type
 	if offerType != "offer" {
-		return "", fmt.Errorf("expected offer type 'offer', got '%s'", offerType)
+		return nil, "", fmt.Errorf("expected offer type 'offer', got '%s'", offerType)
 	}
 
-	// Lock to ensure only one connection at a time
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Close any existing connections
-	s.closeExistingConnections()
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
 
 	// Create a new peer connection without ICE servers for local network
 	config := webrtc.Configuration{
 		// No ICE servers needed for local network connections
 	}
 
-	var err error
-	s.peerConnection, err = s.api.NewPeerConnection(config)
+	s.peerConnectionMutex.Lock()
+	peerConnection, err := s.api.NewPeerConnection(config)
+	statsGetter := s.pendingStatsGetter
+	estimator := s.pendingEstimator
+	s.pendingStatsGetter = nil
+	s.pendingEstimator = nil
+	s.peerConnectionMutex.Unlock()
 	if err != nil {
-		return "", fmt.Errorf("failed to create peer connection: %v", err)
+		return nil, "", fmt.Errorf("failed to create peer connection: %v", err)
 	}
 
-	// Add video track if video is enabled
-	if s.videoEnabled && s.videoHandler != nil {
-		videoTrack, err := s.videoHandler.CreateTrack()
-		if err != nil {
-			return "", fmt.Errorf("failed to create video track: %v", err)
-		}
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &Session{
+		id:             sessionID,
+		peerConnection: peerConnection,
+		createdAt:      time.Now(),
+		ctx:            ctx,
+		cancel:         cancel,
+		senders:        make(map[string]*webrtc.RTPSender),
+		dataChannels:   make(map[string]*webrtc.DataChannel),
+		messenger:      newMessenger(),
+		statsGetter:    statsGetter,
+		estimator:      estimator,
+		recorder:       s.recorder,
+		tracks:         make(map[string]webrtc.TrackLocal),
+		tracksOn:       make(map[string]bool),
+		mediaHeld:      make(map[string]webrtc.TrackLocal),
+	}
 
-		_, err = s.peerConnection.AddTrack(videoTrack)
-		if err != nil {
-			return "", fmt.Errorf("failed to add video track: %v", err)
-		}
+	// Add the tracks the client requested with its offer, if they are enabled
+	offered, err := offerMedia(offerSDP)
+	if err != nil {
+		peerConnection.Close()
+		return nil, "", err
 	}
+	sess.offeredCodecs = offered
+
+	for _, kind := range mediaKinds {
+		handler := s.mediaHandler(kind)
+		if _, ok := offered[kind]; handler == nil || !ok {
+			continue
+		}
 
-	// Add audio track if audio is enabled
-	if s.audioEnabled && s.audioHandler != nil {
-		audioTrack, err := s.audioHandler.CreateTrack()
+		track, err := handler.CreateTrack(offered[kind])
 		if err != nil {
-			return "", fmt.Errorf("failed to create audio track: %v", err)
+			peerConnection.Close()
+			return nil, "", fmt.Errorf("failed to create %s track: %v", kind, err)
 		}
 
-		_, err = s.peerConnection.AddTrack(audioTrack)
+		sender, err := sess.addTrack(kind, track)
 		if err != nil {
-			return "", fmt.Errorf("failed to add audio track: %v", err)
+			peerConnection.Close()
+			return nil, "", err
 		}
+		go s.readRTCP(kind, sender)
 	}
 
-	// Set up data channel event handler
-	s.peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
-		fmt.Printf("New DataChannel %s %d\n", dc.Label(), dc.ID())
-		s.dataChannel = dc
+	// Set up the data channels created by the server and by the client
+	if err := s.createNegotiatedChannels(sess); err != nil {
+		peerConnection.Close()
+		return nil, "", err
+	}
 
-		// Handle incoming messages
-		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			message := string(msg.Data)
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		s.setupDataChannel(sess, dc, true)
+	})
 
-			// Call all registered callbacks (copy under lock to avoid holding lock while calling)
-			s.mutex.Lock()
-			callbacks := append([]func(string){}, s.messageCallbacks...)
-			s.mutex.Unlock()
+	// Tracks sent by the client, see talk.go and publish.go
+	peerConnection.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		s.handleRemoteTrack(sess, remote)
+	})
 
-			for _, cb := range callbacks {
-				cb(message)
-			}
-		})
-
-		dc.OnOpen(func() {
-			fmt.Println("Data channel opened - new connection established")
-			// Create a new stop channel for this connection
-			s.stopChan = make(chan bool)
-
-			// Start video streaming if enabled
-			if s.videoEnabled && s.videoHandler != nil {
-				if err := s.videoHandler.StartStreaming(); err != nil {
-					fmt.Printf("Failed to start video streaming: %v\n", err)
-				} else {
-					fmt.Println("Video streaming started")
-				}
-			}
+	// Add connection state change handler to start media once connected and to close the session on a failed connection.
+	// Media is not bound to the data channel, because WHEP clients connect without one.
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		fmt.Printf("PeerConnection state of session %s changed: %s\n", sess.id, state.String())
+		stateTransitionsMetric.With(state.String()).Inc()
 
-			// Start audio streaming if enabled
-			if s.audioEnabled && s.audioHandler != nil {
-				if err := s.audioHandler.StartStreaming(); err != nil {
-					fmt.Printf("Failed to start audio streaming: %v\n", err)
-				} else {
-					fmt.Println("Audio streaming started")
-				}
-			}
-		})
-
-		dc.OnClose(func() {
-			fmt.Println("Data channel closed - connection terminated")
-			// Stop video streaming
-			if s.videoEnabled && s.videoHandler != nil {
-				s.videoHandler.StopStreaming()
-				fmt.Println("Video streaming stopped")
-			}
-			// Stop audio streaming
-			if s.audioEnabled && s.audioHandler != nil {
-				s.audioHandler.StopStreaming()
-				fmt.Println("Audio streaming stopped")
-			}
-		})
-	})
+		s.mutex.Lock()
+		callbacks := append([]func(string, string){}, s.stateCallbacks...)
+		s.mutex.Unlock()
 
-	// Add connection state change handler to stop streaming on lost connection
-	s.peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		fmt.Printf("PeerConnection state changed: %s\n", state.String())
-		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateClosed {
-			if s.videoEnabled && s.videoHandler != nil {
-				s.videoHandler.StopStreaming()
-				fmt.Println("Video streaming stopped (connection lost)")
-			}
-			if s.audioEnabled && s.audioHandler != nil {
-				s.audioHandler.StopStreaming()
-				fmt.Println("Audio streaming stopped (connection lost)")
+		for _, cb := range callbacks {
+			cb(sess.id, state.String())
+		}
+
+		if state == webrtc.PeerConnectionStateConnected {
+			sess.mutex.Lock()
+			firstConnect := !sess.connected
+			sess.connected = true
+			sess.mutex.Unlock()
+
+			s.syncMedia(sess)
+
+			if firstConnect {
+				go s.collectStats(sess)
 			}
 		}
+		// Disconnected is transient and ICE often recovers from it, the callbacks above already trigger the failsafe
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.closeSession(sess)
+		}
 	})
 
 	// Set the remote description
@@ -338,26 +656,43 @@ func (s *Server) processOffer(offerType, offerSDP string) (string, error) {
 		SDP:  offerSDP,
 	}
 
-	if err := s.peerConnection.SetRemoteDescription(offer); err != nil {
-		return "", fmt.Errorf("failed to set remote description: %v", err)
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		peerConnection.Close()
+		return nil, "", fmt.Errorf("failed to set remote description: %v", err)
 	}
 
 	// Create answer
-	answer, err := s.peerConnection.CreateAnswer(nil)
+	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create answer: %v", err)
+		peerConnection.Close()
+		return nil, "", fmt.Errorf("failed to create answer: %v", err)
+	}
+
+	// Collect candidates for the candidates endpoint instead of waiting for them
+	if trickle {
+		sess.enableTrickle()
 	}
 
 	// Set local description
-	if err := s.peerConnection.SetLocalDescription(answer); err != nil {
-		return "", fmt.Errorf("failed to set local description: %v", err)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		return nil, "", fmt.Errorf("failed to set local description: %v", err)
+	}
+
+	// Register the session before waiting for ICE gathering, so it is never missing while connecting
+	s.mutex.Lock()
+	s.sessions[sess.id] = sess
+	s.mutex.Unlock()
+
+	if trickle {
+		return sess, peerConnection.LocalDescription().SDP, nil
 	}
 
 	// Wait for ICE gathering to complete
-	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 	<-gatherComplete
 
-	return s.peerConnection.LocalDescription().SDP, nil
+	return sess, peerConnection.LocalDescription().SDP, nil
 }
 
 func (s *Server) sendError(w http.ResponseWriter, message string) {
@@ -0,0 +1,228 @@
+package webrtcserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// Session represents a single connected peer with its own peer connection and data channel
+type Session struct {
+	id             string
+	peerConnection *webrtc.PeerConnection
+	dataChannels   map[string]*webrtc.DataChannel // data channels keyed by label, see channels.go
+	primaryLabel   string                         // label of the first data channel created by the client
+	createdAt      time.Time
+	connected      bool // true once the peer connection is connected
+	closed         bool
+	ctx            context.Context // cancelled when the session is closed
+	cancel         context.CancelFunc
+	messenger      *messenger            // typed message state, see protocol.go
+	statsGetter    stats.Getter          // RTP stats of the peer connection, see stats.go
+	estimator      cc.BandwidthEstimator // bandwidth estimate of the peer connection, see bitrate.go
+	linkStats      LinkStats             // latest sample of the stats collector
+	statsOn        bool                  // true while the client receives the samples, see stats.go
+	stats          SessionStats
+	trickle        *trickleState                // nil unless the session was created with trickle ICE
+	signaling      *signalingChannel            // nil unless the session uses WebSocket signaling
+	senders        map[string]*webrtc.RTPSender // media senders keyed by track kind ("video", "audio")
+	offeredCodecs  map[string][]string          // MIME types of the codecs offered by the client per kind
+	tracks         map[string]webrtc.TrackLocal // track per kind, kept while the track is switched off
+	tracksOn       map[string]bool              // track kinds which are currently sent
+	mediaHeld      map[string]webrtc.TrackLocal // tracks this session has added to their media pipeline
+	recorder       *recorder                    // records the messages of the session, see recorder.go
+	microphone     bool                         // true while the client sends a microphone track, see talk.go
+	mutex          sync.Mutex
+}
+
+// SessionStats holds the message counters of a session
+type SessionStats struct {
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	BytesReceived    uint64 `json:"bytesReceived"`
+	BytesSent        uint64 `json:"bytesSent"`
+}
+
+// SessionInfo is a snapshot of a session returned by Server.Sessions
+type SessionInfo struct {
+	ID              string       `json:"id"`
+	CreatedAt       time.Time    `json:"createdAt"`
+	ConnectionState string       `json:"connectionState"`
+	DataChannelOpen bool         `json:"dataChannelOpen"`
+	Stats           SessionStats `json:"stats"`
+}
+
+// newSessionID returns a random 16 character hex string
+func newSessionID() (string, error) {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// ID returns the unique identifier of the session
+func (sess *Session) ID() string {
+	return sess.id
+}
+
+// sendText sends a text message through the primary data channel of the session
+func (sess *Session) sendText(data string) error {
+	sess.mutex.Lock()
+	label := sess.primaryLabel
+	sess.mutex.Unlock()
+
+	return sess.sendTextOn(label, data)
+}
+
+// sendTextOn sends a text message through the data channel with the given label
+func (sess *Session) sendTextOn(label, data string) error {
+	return sess.sendOn(label, []byte(data), false)
+}
+
+// sendBinary sends a binary message through the primary data channel of the session
+func (sess *Session) sendBinary(data []byte) error {
+	sess.mutex.Lock()
+	label := sess.primaryLabel
+	sess.mutex.Unlock()
+
+	return sess.sendOn(label, data, true)
+}
+
+// sendOn sends a text or binary message through the data channel with the given label
+func (sess *Session) sendOn(label string, data []byte, binary bool) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	dataChannel := sess.dataChannels[label]
+	if dataChannel == nil {
+		return fmt.Errorf("data channel is not available")
+	}
+
+	if dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("data channel is not open")
+	}
+
+	var err error
+	if binary {
+		err = dataChannel.Send(data)
+	} else {
+		err = dataChannel.SendText(string(data))
+	}
+	if err != nil {
+		return err
+	}
+
+	sess.stats.MessagesSent++
+	sess.stats.BytesSent += uint64(len(data))
+	messagesMetric.With("out").Inc()
+	messageBytesMetric.With("out").Add(uint64(len(data)))
+	sess.recorder.message("datachannel", "out", sess.id, label, data, binary)
+	return nil
+}
+
+// isOpen returns true if the primary data channel of the session is connected and ready
+func (sess *Session) isOpen() bool {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	return sess.isOpenLocked()
+}
+
+func (sess *Session) isOpenLocked() bool {
+	dataChannel := sess.dataChannels[sess.primaryLabel]
+	return dataChannel != nil && dataChannel.ReadyState() == webrtc.DataChannelStateOpen
+}
+
+// recordReceived updates the receive counters of the session and adds the message to the current recording
+func (sess *Session) recordReceived(label string, msg webrtc.DataChannelMessage) {
+	sess.mutex.Lock()
+	sess.stats.MessagesReceived++
+	sess.stats.BytesReceived += uint64(len(msg.Data))
+	sess.mutex.Unlock()
+
+	messagesMetric.With("in").Inc()
+	messageBytesMetric.With("in").Add(uint64(len(msg.Data)))
+	sess.recorder.message("datachannel", "in", sess.id, label, msg.Data, !msg.IsString)
+}
+
+// info returns a snapshot of the session
+func (sess *Session) info() SessionInfo {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	return SessionInfo{
+		ID:              sess.id,
+		CreatedAt:       sess.createdAt,
+		ConnectionState: sess.peerConnection.ConnectionState().String(),
+		DataChannelOpen: sess.isOpenLocked(),
+		Stats:           sess.stats,
+	}
+}
+
+// addTrack adds a media track of the given kind to the session and returns its new sender, nil if the session already has one
+func (sess *Session) addTrack(kind string, track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	if sess.senders[kind] != nil {
+		return nil, nil
+	}
+
+	sender, err := sess.peerConnection.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s track: %w", kind, err)
+	}
+
+	sess.senders[kind] = sender
+	sess.tracks[kind] = track
+	sess.tracksOn[kind] = true
+	return sender, nil
+}
+
+// removeTrack removes the media track of the given kind from the session
+func (sess *Session) removeTrack(kind string) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	sender := sess.senders[kind]
+	if sender == nil {
+		return nil
+	}
+
+	if err := sess.peerConnection.RemoveTrack(sender); err != nil {
+		return fmt.Errorf("failed to remove %s track: %w", kind, err)
+	}
+
+	delete(sess.senders, kind)
+	sess.tracksOn[kind] = false
+	return nil
+}
+
+// replaceTrack switches the track of an existing sender without renegotiation. A nil track stops sending.
+func (sess *Session) replaceTrack(kind string, track webrtc.TrackLocal) error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	sender := sess.senders[kind]
+	if sender == nil {
+		return fmt.Errorf("session has no %s sender", kind)
+	}
+
+	if err := sender.ReplaceTrack(track); err != nil {
+		return fmt.Errorf("failed to replace %s track: %w", kind, err)
+	}
+
+	if track != nil {
+		sess.tracks[kind] = track
+	}
+	sess.tracksOn[kind] = track != nil
+	return nil
+}
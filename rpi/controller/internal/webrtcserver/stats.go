@@ -0,0 +1,270 @@
+// The stats collector samples the link quality of every connected session periodically:
+// round trip time of the selected candidate pair, RTP bytes and packets sent per track,
+// loss, jitter and round trip time from the RTCP receiver reports of the client and the buffered amount of the data channels.
+// The samples are available by LinkStats and by GET /api/stats. A client can subscribe to them over the data channel:
+//   STATS ON | STATS OFF
+// The server replies with STATS ON or STATS OFF (STATS ERROR <reason> on invalid commands) and pushes every sample
+// to a subscribed client as typed "stats" message.
+
+package webrtcserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// statsInterval is the time between two samples of the stats collector
+const statsInterval = 2 * time.Second
+
+// statsPrefix marks data channel messages that subscribe to the stats push
+const statsPrefix = "STATS "
+
+// LinkStats describes the link quality of a session
+type LinkStats struct {
+	SessionID                 string       `json:"sessionId"`
+	Timestamp                 time.Time    `json:"timestamp"`
+	RoundTripTime             float64      `json:"roundTripTime"`                      // seconds
+	AvailableOutgoingBitrate  float64      `json:"availableOutgoingBitrate,omitempty"` // bits per second
+	DataChannelBufferedAmount uint64       `json:"dataChannelBufferedAmount"`
+	Tracks                    []TrackStats `json:"tracks"`
+}
+
+// TrackStats describes a media track sent to a session
+type TrackStats struct {
+	Kind          string  `json:"kind"`
+	SSRC          uint32  `json:"ssrc"`
+	PacketsSent   uint64  `json:"packetsSent"`
+	BytesSent     uint64  `json:"bytesSent"`
+	Bitrate       float64 `json:"bitrate"` // bits per second since the previous sample
+	PacketsLost   int64   `json:"packetsLost"`
+	FractionLost  float64 `json:"fractionLost"`
+	Jitter        float64 `json:"jitter"`        // seconds
+	RoundTripTime float64 `json:"roundTripTime"` // seconds, from RTCP receiver reports
+	NACKCount     uint32  `json:"nackCount"`     // RTCP feedback of the client, see rtcp.go
+	PLICount      uint32  `json:"pliCount"`
+	FIRCount      uint32  `json:"firCount"`
+}
+
+// statsSummary is the compact form of LinkStats pushed to the client
+type statsSummary struct {
+	RoundTripTime float64 `json:"rttMs"`
+	FractionLost  float64 `json:"loss"`
+	Bitrate       float64 `json:"kbps"`
+	Buffered      uint64  `json:"buffered"`
+}
+
+// LinkStats returns the latest link quality sample of the session with the given id
+func (s *Server) LinkStats(sessionID string) (LinkStats, bool) {
+	sess := s.session(sessionID)
+	if sess == nil {
+		return LinkStats{}, false
+	}
+
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	return sess.linkStats, !sess.linkStats.Timestamp.IsZero()
+}
+
+// AllLinkStats returns the latest link quality samples of all sessions
+func (s *Server) AllLinkStats() []LinkStats {
+	result := []LinkStats{}
+	for _, info := range s.Sessions() {
+		if linkStats, ok := s.LinkStats(info.ID); ok {
+			result = append(result, linkStats)
+		}
+	}
+	return result
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if sessionID := r.URL.Query().Get("session"); sessionID != "" {
+		linkStats, ok := s.LinkStats(sessionID)
+		if !ok {
+			http.Error(w, "No stats for session", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(linkStats)
+		return
+	}
+
+	json.NewEncoder(w).Encode(s.AllLinkStats())
+}
+
+// collectStats samples the link quality of the session until it is closed
+func (s *Server) collectStats(sess *Session) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	previous := make(map[uint32]TrackStats)
+	previousTime := time.Now()
+
+	for {
+		select {
+		case <-sess.ctx.Done():
+			return
+		case now := <-ticker.C:
+			linkStats := sess.sampleStats(previous, now.Sub(previousTime))
+			previousTime = now
+
+			for _, track := range linkStats.Tracks {
+				previous[track.SSRC] = track
+			}
+
+			sess.mutex.Lock()
+			sess.linkStats = linkStats
+			subscribed := sess.statsOn
+			sess.mutex.Unlock()
+
+			if subscribed && sess.isOpen() {
+				sess.sendMessage("stats", linkStats.summary(), 0, "")
+			}
+		}
+	}
+}
+
+// handleStatsMessage processes a STATS message of the data channel
+func (s *Server) handleStatsMessage(sess *Session, message string) {
+	var subscribed bool
+	switch strings.TrimSpace(strings.TrimPrefix(message, statsPrefix)) {
+	case "ON":
+		subscribed = true
+	case "OFF":
+	default:
+		sess.sendText(statsPrefix + "ERROR invalid command")
+		return
+	}
+
+	sess.mutex.Lock()
+	sess.statsOn = subscribed
+	sess.mutex.Unlock()
+
+	if subscribed {
+		sess.sendText(statsPrefix + "ON")
+	} else {
+		sess.sendText(statsPrefix + "OFF")
+	}
+}
+
+// sampleStats takes a link quality sample of the session
+func (sess *Session) sampleStats(previous map[uint32]TrackStats, elapsed time.Duration) LinkStats {
+	linkStats := LinkStats{
+		SessionID: sess.id,
+		Timestamp: time.Now(),
+		Tracks:    []TrackStats{},
+	}
+
+	// Round trip time of the selected candidate pair and buffered amount of the data channels
+	for _, report := range sess.peerConnection.GetStats() {
+		switch report := report.(type) {
+		case webrtc.ICECandidatePairStats:
+			if report.Nominated && report.State == webrtc.StatsICECandidatePairStateSucceeded {
+				linkStats.RoundTripTime = report.CurrentRoundTripTime
+				linkStats.AvailableOutgoingBitrate = report.AvailableOutgoingBitrate
+			}
+		}
+	}
+
+	sess.mutex.Lock()
+	for _, dataChannel := range sess.dataChannels {
+		linkStats.DataChannelBufferedAmount += dataChannel.BufferedAmount()
+	}
+	senders := make(map[string]*webrtc.RTPSender, len(sess.senders))
+	for kind, sender := range sess.senders {
+		senders[kind] = sender
+	}
+	getter := sess.statsGetter
+	estimator := sess.estimator
+	sess.mutex.Unlock()
+
+	// An ICE lite agent does not estimate the outgoing bitrate itself, use the congestion controller instead
+	if linkStats.AvailableOutgoingBitrate == 0 && estimator != nil {
+		linkStats.AvailableOutgoingBitrate = float64(estimator.GetTargetBitrate())
+	}
+
+	if getter == nil {
+		return linkStats
+	}
+
+	// RTP stats of the sent tracks, remote inbound stats come from the RTCP receiver reports of the client
+	for kind, sender := range senders {
+		for _, encoding := range sender.GetParameters().Encodings {
+			ssrc := uint32(encoding.SSRC)
+			streamStats := getter.Get(ssrc)
+			if streamStats == nil {
+				continue
+			}
+
+			track := TrackStats{
+				Kind:          kind,
+				SSRC:          ssrc,
+				PacketsSent:   streamStats.OutboundRTPStreamStats.PacketsSent,
+				BytesSent:     streamStats.OutboundRTPStreamStats.BytesSent,
+				PacketsLost:   streamStats.RemoteInboundRTPStreamStats.PacketsLost,
+				FractionLost:  streamStats.RemoteInboundRTPStreamStats.FractionLost,
+				Jitter:        streamStats.RemoteInboundRTPStreamStats.Jitter,
+				RoundTripTime: streamStats.RemoteInboundRTPStreamStats.RoundTripTime.Seconds(),
+				NACKCount:     streamStats.OutboundRTPStreamStats.NACKCount,
+				PLICount:      streamStats.OutboundRTPStreamStats.PLICount,
+				FIRCount:      streamStats.OutboundRTPStreamStats.FIRCount,
+			}
+
+			if last, ok := previous[ssrc]; ok && elapsed > 0 && track.BytesSent >= last.BytesSent {
+				track.Bitrate = float64(track.BytesSent-last.BytesSent) * 8 / elapsed.Seconds()
+			}
+
+			// An ICE lite agent does not measure the round trip time itself, use the RTCP one instead
+			if linkStats.RoundTripTime == 0 {
+				linkStats.RoundTripTime = track.RoundTripTime
+			}
+
+			linkStats.Tracks = append(linkStats.Tracks, track)
+		}
+	}
+
+	return linkStats
+}
+
+// summary returns the compact form of the sample
+func (ls LinkStats) summary() statsSummary {
+	summary := statsSummary{
+		RoundTripTime: ls.RoundTripTime * 1000,
+		Buffered:      ls.DataChannelBufferedAmount,
+	}
+
+	for _, track := range ls.Tracks {
+		summary.Bitrate += track.Bitrate / 1000
+		if track.FractionLost > summary.FractionLost {
+			summary.FractionLost = track.FractionLost
+		}
+	}
+	return summary
+}
+
+// newStatsInterceptor creates the stats interceptor, which hands the stats getter of each new peer connection to the server
+func (s *Server) newStatsInterceptor() (*stats.InterceptorFactory, error) {
+	factory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+
+	// Called synchronously inside NewPeerConnection, which is serialized by peerConnectionMutex
+	factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		s.pendingStatsGetter = getter
+	})
+	return factory, nil
+}
@@ -0,0 +1,123 @@
+// Two-way audio: a client can send its microphone with the audio transceiver of its offer (sendrecv or sendonly).
+// The microphone is only played on the speaker of the robot while the session holds push-to-talk, one session at a time:
+//   TALK ON | TALK OFF
+// The server replies with TALK ON, TALK OFF, TALK BUSY if another session talks or TALK ERROR <reason>.
+// Push-to-talk is released when the session closes. The speaker pipeline runs while at least one session sends a microphone.
+
+package webrtcserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// talkPrefix marks data channel messages that switch push-to-talk
+const talkPrefix = "TALK "
+
+// handleRemoteTrack processes a track sent by the client until it ends
+func (s *Server) handleRemoteTrack(sess *Session, remote *webrtc.TrackRemote) {
+	fmt.Printf("Session %s sends %s track (%s)\n", sess.id, remote.Kind(), remote.Codec().MimeType)
+
+	switch {
+	case remote.Kind() == webrtc.RTPCodecTypeAudio && strings.EqualFold(remote.Codec().MimeType, webrtc.MimeTypeOpus):
+		s.playMicrophone(sess, remote)
+	case remote.Kind() == webrtc.RTPCodecTypeVideo:
+		s.receivePublished(sess, remote) // see publish.go
+	default:
+		fmt.Printf("Ignoring %s track of session %s\n", remote.Codec().MimeType, sess.id)
+	}
+}
+
+// playMicrophone forwards the microphone of the session to the speaker while the session holds push-to-talk
+func (s *Server) playMicrophone(sess *Session, remote *webrtc.TrackRemote) {
+	if s.speakerHandler == nil {
+		return
+	}
+
+	sess.mutex.Lock()
+	sess.microphone = true
+	sess.mutex.Unlock()
+
+	defer func() {
+		sess.mutex.Lock()
+		sess.microphone = false
+		sess.mutex.Unlock()
+		s.releaseTalk(sess.id)
+	}()
+
+	if err := s.speakerHandler.Acquire(); err != nil {
+		fmt.Printf("Failed to start speaker: %v\n", err)
+		return
+	}
+	defer s.speakerHandler.Release()
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			// The track ends with the peer connection
+			return
+		}
+
+		if s.talking(sess.id) {
+			s.speakerHandler.WriteRTP(packet)
+		}
+	}
+}
+
+// talking returns true if the session holds push-to-talk
+func (s *Server) talking(sessionID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.talker == sessionID
+}
+
+// handleTalkMessage processes a TALK message of the data channel
+func (s *Server) handleTalkMessage(sess *Session, message string) {
+	command := strings.TrimSpace(strings.TrimPrefix(message, talkPrefix))
+
+	switch command {
+	case "ON":
+		sess.mutex.Lock()
+		microphone := sess.microphone
+		sess.mutex.Unlock()
+
+		if s.speakerHandler == nil {
+			sess.sendText(talkPrefix + "ERROR audio is not enabled")
+			return
+		}
+		if !microphone {
+			sess.sendText(talkPrefix + "ERROR session sends no microphone")
+			return
+		}
+
+		s.mutex.Lock()
+		busy := s.talker != "" && s.talker != sess.id
+		if !busy {
+			s.talker = sess.id
+		}
+		s.mutex.Unlock()
+
+		if busy {
+			sess.sendText(talkPrefix + "BUSY")
+			return
+		}
+		sess.sendText(talkPrefix + "ON")
+	case "OFF":
+		s.releaseTalk(sess.id)
+		sess.sendText(talkPrefix + "OFF")
+	default:
+		sess.sendText(talkPrefix + "ERROR invalid command")
+	}
+}
+
+// releaseTalk takes push-to-talk from the session, if it holds it
+func (s *Server) releaseTalk(sessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.talker == sessionID {
+		s.talker = ""
+	}
+}
@@ -0,0 +1,148 @@
+// Trickle ICE: when the offer is sent with "trickle": true, /api/offer answers immediately without waiting for ICE gathering.
+// The server candidates are delivered afterwards as server-sent events by GET /api/sessions/{id}/candidates,
+// client candidates are accepted by POST /api/sessions/{id}/candidates.
+// The manual and auto handshake pages pass the answer on as a single string, so they keep using the blocking mode.
+
+package webrtcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// trickleState buffers the local ICE candidates of a session until they are fetched
+type trickleState struct {
+	candidates []webrtc.ICECandidateInit
+	done       bool          // true after the last candidate has been gathered
+	notify     chan struct{} // closed and replaced whenever candidates or done change
+}
+
+// enableTrickle starts collecting the local ICE candidates of the session.
+// It must be called before the local description is set.
+func (sess *Session) enableTrickle() {
+	sess.mutex.Lock()
+	sess.trickle = &trickleState{notify: make(chan struct{})}
+	sess.mutex.Unlock()
+
+	sess.peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		sess.mutex.Lock()
+		defer sess.mutex.Unlock()
+
+		// A nil candidate signals the end of gathering
+		if candidate == nil {
+			sess.trickle.done = true
+		} else {
+			sess.trickle.candidates = append(sess.trickle.candidates, candidate.ToJSON())
+		}
+
+		close(sess.trickle.notify)
+		sess.trickle.notify = make(chan struct{})
+	})
+}
+
+// localCandidates returns the buffered candidates starting at offset, whether gathering is done
+// and a channel, which is closed when the result changes
+func (sess *Session) localCandidates(offset int) ([]webrtc.ICECandidateInit, bool, <-chan struct{}) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	candidates := append([]webrtc.ICECandidateInit{}, sess.trickle.candidates[offset:]...)
+	return candidates, sess.trickle.done, sess.trickle.notify
+}
+
+// handleCandidates streams server candidates on GET and adds client candidates on POST
+func (s *Server) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	// Enable CORS
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	sess := s.session(r.PathValue("id"))
+	if sess == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.streamCandidates(w, r, sess)
+	case "POST":
+		var candidate webrtc.ICECandidateInit
+		if err := json.NewDecoder(r.Body).Decode(&candidate); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// An empty candidate signals the end of the client candidates, there is nothing to do for it
+		if candidate.Candidate == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := sess.peerConnection.AddICECandidate(candidate); err != nil {
+			http.Error(w, "Error adding candidate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamCandidates writes the server candidates of the session as server-sent events.
+// Each candidate is sent as "candidate" event, the stream ends with an "end-of-candidates" event.
+func (s *Server) streamCandidates(w http.ResponseWriter, r *http.Request, sess *Session) {
+	sess.mutex.Lock()
+	trickle := sess.trickle != nil
+	sess.mutex.Unlock()
+
+	if !trickle {
+		http.Error(w, "Session was not created with trickle ICE", http.StatusConflict)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	offset := 0
+	for {
+		candidates, done, notify := sess.localCandidates(offset)
+		offset += len(candidates)
+
+		for _, candidate := range candidates {
+			data, err := json.Marshal(candidate)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: candidate\ndata: %s\n\n", data)
+		}
+
+		if done {
+			fmt.Fprint(w, "event: end-of-candidates\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-sess.ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// WebSocket signaling keeps a signaling channel open for the whole session, so tracks can be added or removed after connect.
+// All messages are JSON objects with a "type" field:
+//   offer      {"type":"offer","sdp":"..."}          first offer creates the session, later offers renegotiate it
+//   answer     {"type":"answer","sdp":"...","sessionId":"..."}
+//   candidate  {"type":"candidate","candidate":{...}} ICE candidates in both directions, trickled
+//   error      {"type":"error","error":"..."}
+// When tracks change on the server (see SetVideo and SetAudio), the server sends its own offer and expects an answer.
+// The server is the polite peer: if both sides send an offer at the same time, it rolls back its own offer.
+
+package webrtcserver
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+// signalingMessage is a message of the WebSocket signaling channel
+type signalingMessage struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	SessionID string                   `json:"sessionId,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+// signalingChannel serializes writes to the WebSocket of a session
+type signalingChannel struct {
+	conn  *websocket.Conn
+	mutex sync.Mutex
+}
+
+func (sc *signalingChannel) send(msg signalingMessage) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	return websocket.JSON.Send(sc.conn, msg)
+}
+
+// handleWebSocket runs the signaling channel of a single session until the WebSocket is closed.
+// Closing the WebSocket does not close the session, it just cannot be renegotiated anymore.
+func (s *Server) handleWebSocket(conn *websocket.Conn) {
+	defer conn.Close()
+
+	signaling := &signalingChannel{conn: conn}
+	var sess *Session
+
+	defer func() {
+		if sess != nil {
+			sess.mutex.Lock()
+			sess.signaling = nil
+			sess.mutex.Unlock()
+		}
+	}()
+
+	for {
+		var msg signalingMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+
+		var err error
+		switch msg.Type {
+		case "offer":
+			if sess == nil {
+				sess, err = s.startWebSocketSession(signaling, msg.SDP)
+			} else {
+				err = sess.acceptOffer(msg.SDP)
+			}
+		case "answer":
+			if sess == nil {
+				err = errors.New("no session")
+				break
+			}
+			err = sess.peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP})
+		case "candidate":
+			if sess == nil || msg.Candidate == nil {
+				err = errors.New("no session or candidate")
+				break
+			}
+			if msg.Candidate.Candidate != "" {
+				err = sess.peerConnection.AddICECandidate(*msg.Candidate)
+			}
+		default:
+			err = fmt.Errorf("unknown message type '%s'", msg.Type)
+		}
+
+		if err != nil {
+			signaling.send(signalingMessage{Type: "error", Error: err.Error()})
+		}
+	}
+}
+
+// startWebSocketSession creates a trickle session for the first offer of a WebSocket
+func (s *Server) startWebSocketSession(signaling *signalingChannel, offerSDP string) (*Session, error) {
+	sess, answer, err := s.processOffer("offer", offerSDP, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.mutex.Lock()
+	sess.signaling = signaling
+	sess.mutex.Unlock()
+
+	if err := signaling.send(signalingMessage{Type: "answer", SDP: answer, SessionID: sess.id}); err != nil {
+		return nil, err
+	}
+
+	// Forward the server candidates as they are gathered
+	go func() {
+		offset := 0
+		for {
+			candidates, done, notify := sess.localCandidates(offset)
+			offset += len(candidates)
+
+			for i := range candidates {
+				if err := signaling.send(signalingMessage{Type: "candidate", Candidate: &candidates[i]}); err != nil {
+					return
+				}
+			}
+
+			if done {
+				return
+			}
+
+			select {
+			case <-notify:
+			case <-sess.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Push an offer whenever tracks are added or removed
+	sess.peerConnection.OnNegotiationNeeded(func() {
+		if err := sess.sendOffer(); err != nil {
+			fmt.Printf("Failed to renegotiate session %s: %v\n", sess.id, err)
+		}
+	})
+
+	// Videos published by other clients are added by renegotiation, see publish.go
+	s.forwardPublications(sess)
+
+	return sess, nil
+}
+
+// acceptOffer answers a renegotiation offer of the client.
+// A pending offer of the server is rolled back, because the server is the polite peer.
+func (sess *Session) acceptOffer(offerSDP string) error {
+	pc := sess.peerConnection
+
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return fmt.Errorf("failed to roll back local offer: %w", err)
+		}
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	return sess.signal(signalingMessage{Type: "answer", SDP: answer.SDP, SessionID: sess.id})
+}
+
+// sendOffer creates a renegotiation offer and sends it over the signaling channel
+func (sess *Session) sendOffer() error {
+	pc := sess.peerConnection
+
+	// Renegotiation only starts from a stable state, otherwise it is triggered again once stable
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return nil
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	return sess.signal(signalingMessage{Type: "offer", SDP: offer.SDP, SessionID: sess.id})
+}
+
+// signal sends a message over the signaling channel of the session
+func (sess *Session) signal(msg signalingMessage) error {
+	sess.mutex.Lock()
+	signaling := sess.signaling
+	sess.mutex.Unlock()
+
+	if signaling == nil {
+		return errors.New("session has no signaling channel")
+	}
+
+	return signaling.send(msg)
+}
@@ -0,0 +1,150 @@
+// WHEP (WebRTC-HTTP Egress Protocol) lets standard players pull the camera and microphone tracks:
+//   POST   /whep       takes an application/sdp offer, returns 201 Created with the answer and the session resource in Location
+//   PATCH  /whep/{id}  takes trickle candidates as application/trickle-ice-sdpfrag
+//   DELETE /whep/{id}  closes the session
+// The answer already contains all server candidates, so clients do not have to wait for any.
+
+package webrtcserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sdpContentType     = "application/sdp"
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+)
+
+func setWHEPHeaders(w http.ResponseWriter) {
+	// Enable CORS
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Accept-Patch")
+}
+
+// handleWHEP creates a new session from an application/sdp offer
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	setWHEPHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Accept-Post", sdpContentType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "Content-Type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, answer, err := s.processOffer("offer", string(offer), false)
+	if err != nil {
+		http.Error(w, "Error processing offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", "/whep/"+sess.id)
+	w.Header().Set("Accept-Patch", sdpFragContentType)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// handleWHEPResource adds trickle candidates to or closes an existing session
+func (s *Server) handleWHEPResource(w http.ResponseWriter, r *http.Request) {
+	setWHEPHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Accept-Patch", sdpFragContentType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sess := s.session(r.PathValue("id"))
+	if sess == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpFragContentType) {
+			http.Error(w, "Content-Type must be "+sdpFragContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		candidates, err := parseSDPFrag(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid SDP fragment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, candidate := range candidates {
+			if err := sess.peerConnection.AddICECandidate(candidate); err != nil {
+				http.Error(w, "Error adding candidate: "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		s.closeSession(sess)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseSDPFrag extracts the ICE candidates of a trickle-ice-sdpfrag body (RFC 8840).
+// Each candidate is assigned to the media section (a=mid) it follows.
+func parseSDPFrag(body io.Reader) ([]webrtc.ICECandidateInit, error) {
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	var mLineIndex uint16
+	mLines := 0
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mLineIndex = uint16(mLines)
+			mLines++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			index := mLineIndex
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: &index,
+			})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read SDP fragment: %w", err)
+	}
+
+	return candidates, nil
+}
@@ -1,18 +1,34 @@
 package main
 
 // set LIST_PORTS=true
+// set LIST_PROFILES=true # prints the media profiles of PROFILES_FILE
 
 // set VID=2341 # can also be empty, then output is logged to console
 // set PID=0069 # can also be empty, then output is logged to console
-// set VIDEO_MODE=windows-privat # can also be empty or set to unknown, then dummy video is used
-// set AUDIO_MODE=windows-privat # can also be empty or set to unknown, then dummy audio is used
+// set FAILSAFE_COMMAND=COMBO 0 0 0 # can also be empty, then "COMBO 0 0 0" is sent, when the control link is lost
+// set FAILSAFE_TIMEOUT=500ms # can also be empty, then 500ms is used. 0 disables the failsafe watchdog
+// set SERIAL_FRAMING=cobs # can also be empty, then lines are read from the serial port and binary data channel messages are not sent to it. With cobs, binary messages are exchanged as COBS frames with CRC16 and the Arduino has to frame everything it sends, text lines are dropped
+// set PROFILES_FILE=profiles.json # can also be empty, then the built-in profiles are used (internal/profiles/default.json)
+// set VIDEO_PROFILE=windows-privat # can also be empty, then the lavfi profile (dummy video of ffmpeg) is used, test plays an embedded test pattern without ffmpeg. VIDEO_MODE is still accepted
+// set AUDIO_PROFILE=windows-privat # can also be empty, then the lavfi profile (dummy audio of ffmpeg) is used, test plays embedded silence without ffmpeg. AUDIO_MODE is still accepted
+// set SPEAKER_PROFILE=linux # can also be empty, then the test profile (discards the microphone of the operator) is used
+// set VIDEO_CODECS=vp9,h264,vp8 # can also be empty, then the codecs of the video profile are used (vp8, vp9, h264, av1)
+// set VIDEO_INGEST=127.0.0.1:5004 # can also be empty, then the ingest of the video profile or a free port receives the RTP
+// set AUDIO_INGEST=127.0.0.1:5006 # can also be empty, then the ingest of the audio profile or a free port receives the RTP
+// set SPEAKER_INGEST=127.0.0.1:5008 # can also be empty, then the ingest of the speaker profile or a free port receives the microphone RTP for ffmpeg
+// set RECORD_DIR=recordings # can also be empty, then recordings (POST /api/recording) are stored in ./recordings
+// set RECORD_MAX_MB=1024 # can also be empty, then the oldest recordings are deleted above 1024 MB
+// set RECORD_MAX_MINUTES=60 # can also be empty, then a recording is continued in a new one after 60 minutes or a quarter of RECORD_MAX_MB
 
 import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/profiles"
 	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/serialcomm"
+	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/watchdog"
 	"github.com/Nico3012/rpi_webrtc_data_channel/rpi/controller/internal/webrtcserver"
 )
 
@@ -30,19 +46,55 @@ func main() {
 		return
 	}
 
+	if os.Getenv("LIST_PROFILES") == "true" {
+		set, err := profiles.Load(os.Getenv("PROFILES_FILE"))
+		if err != nil {
+			log.Fatalf("Error loading profiles: %v", err)
+		}
+		for _, kind := range []string{profiles.KindVideo, profiles.KindAudio, profiles.KindSpeaker} {
+			fmt.Printf("Available %s profiles:\n", kind)
+			for _, profile := range set.Profiles(kind) {
+				fmt.Printf("  %s\n", profile)
+			}
+		}
+		return
+	}
+
 	server := webrtcserver.New("8080", true, true)
 
+	// sendFailsafe delivers the failsafe command to the microcontroller
+	sendFailsafe := func(command string) {
+		log.Printf("Failsafe command (no serial port): %s", command)
+	}
+
 	vid := os.Getenv("VID")
 	pid := os.Getenv("PID")
 	if vid != "" && pid != "" {
-		port, err := serialcomm.NewByVIDPID(vid, pid, 9600)
+		framing := serialcomm.FramingText
+		switch value := os.Getenv("SERIAL_FRAMING"); value {
+		case "":
+		case "cobs":
+			framing = serialcomm.FramingCOBS
+		default:
+			log.Fatalf("Invalid SERIAL_FRAMING %q: expected cobs or empty", value)
+		}
+
+		port, err := serialcomm.NewByVIDPID(vid, pid, 9600, framing)
 		if err != nil {
 			log.Fatalf("Error opening serial port: %v", err)
 		}
 		defer port.Close()
 
+		sendFailsafe = func(command string) {
+			server.RecordSerial("out", []byte(command), false)
+			if err := port.SendData(command); err != nil {
+				log.Printf("Error sending failsafe to serial: %v", err)
+			}
+		}
+
 		// Route messages from server to serial port
-		server.OnMessage(func(msg string) {
+		server.OnMessage(func(sessionID, msg string) {
+			server.RecordSerial("out", []byte(msg), false)
 			err := port.SendData(msg)
 			if err != nil {
 				log.Printf("Error sending to serial: %v", err)
@@ -51,17 +103,84 @@ func main() {
 
 		// Route messages from serial port to server
 		port.SetDataCallback(func(msg string) {
+			server.RecordSerial("in", []byte(msg), false)
 			err := server.SendData(msg)
 			if err != nil {
 				log.Printf("Error sending to server: %v", err)
 			}
 		})
+
+		if framing == serialcomm.FramingCOBS {
+			// Route binary messages from server to serial port
+			server.OnBinaryMessage(func(sessionID string, data []byte) {
+				server.RecordSerial("out", data, true)
+				err := port.SendFrame(data)
+				if err != nil {
+					log.Printf("Error sending frame to serial: %v", err)
+				}
+			})
+
+			// Route binary frames from serial port to server
+			port.SetFrameCallback(func(data []byte) {
+				server.RecordSerial("in", data, true)
+				err := server.SendBinary(data)
+				if err != nil {
+					log.Printf("Error sending binary to server: %v", err)
+				}
+			})
+		}
 	} else {
 		// Log messages from server to console
-		server.OnMessage(func(msg string) {
-			log.Printf("Received message: %s", msg)
+		server.OnMessage(func(sessionID, msg string) {
+			log.Printf("Received message from session %s: %s", sessionID, msg)
+		})
+		server.OnBinaryMessage(func(sessionID string, data []byte) {
+			log.Printf("Received binary message from session %s: % x", sessionID, data)
+		})
+	}
+
+	failsafeCommand := os.Getenv("FAILSAFE_COMMAND")
+	if failsafeCommand == "" {
+		failsafeCommand = "COMBO 0 0 0"
+	}
+
+	failsafeTimeout := 500 * time.Millisecond
+	if value := os.Getenv("FAILSAFE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Error parsing FAILSAFE_TIMEOUT: %v", err)
+		}
+		failsafeTimeout = timeout
+	}
+
+	if failsafeTimeout > 0 {
+		// Send the failsafe command when the session in control goes silent or loses its connection
+		wd := watchdog.New(failsafeTimeout, func(sessionID, reason string) {
+			log.Printf("Failsafe triggered for session %s: %s", sessionID, reason)
+			sendFailsafe(failsafeCommand)
+
+			// Tell all observers
+			event := failsafeEvent{SessionID: sessionID, Reason: reason}
+			if err := server.SendMessage("failsafe", event); err != nil {
+				log.Printf("Error sending failsafe event: %v", err)
+			}
+		})
+		defer wd.Stop()
+
+		// Every message of the session in control feeds the watchdog, including typed messages and named channels
+		server.OnActivity(wd.Feed)
+		server.OnSessionState(func(sessionID, state string) {
+			if state == "disconnected" || state == "failed" || state == "closed" {
+				wd.Lost(sessionID)
+			}
 		})
 	}
 
 	select {}
 }
+
+// failsafeEvent is sent as typed "failsafe" message to all sessions, when the failsafe is triggered
+type failsafeEvent struct {
+	SessionID string `json:"sessionId"`
+	Reason    string `json:"reason"`
+}
@@ -3,6 +3,7 @@
 // use the isConnected() method to get a boolean, wether the data channel can be used.
 // use the sendData(data: string) method to send data to the client
 // use the getVideoStream() and getAudioStream() methods to get the current MediaStream. If no MediaStream is available, null is returned
+// use the setVideoEnabled(enabled: boolean) and setAudioEnabled(enabled: boolean) methods to pause or resume a requested track on the controller (e.g. to save bandwidth)
 // listen for "connection-update" event, to be notified, when anything changes on the connection
 // listen for "message-received" event to access incomming messages with event.detail.message
 
@@ -115,6 +116,18 @@ export class WebRTCConnection extends LitElement {
         this.dataChannel.send(data);
     }
 
+    /** @public @param {boolean} enabled @returns {void} */
+    setVideoEnabled(enabled) {
+        if (!this.requestVideo) throw new Error('Video was not requested');
+        this.sendData(`MEDIA VIDEO ${enabled ? 'ON' : 'OFF'}`);
+    }
+
+    /** @public @param {boolean} enabled @returns {void} */
+    setAudioEnabled(enabled) {
+        if (!this.requestAudio) throw new Error('Audio was not requested');
+        this.sendData(`MEDIA AUDIO ${enabled ? 'ON' : 'OFF'}`);
+    }
+
     /** @private */
     reset() {
         console.log('Reset webrtc-component now.');